@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+const (
+	RestoreMerge   = "merge"
+	RestoreReplace = "replace"
+)
+
+// backupPage is how many entries a backup reads at a time.
+const backupPage = 256
+
+// Backup calls fn with a copy of every entry in key order, until fn
+// returns an error. Entries are read a page at a time and each is copied
+// as it is when it's reached, so nothing is held still for the length of
+// it and writes carry on meanwhile. Those may or may not be included, so
+// a copy is brought up to date by the change feed from any revision read
+// before calling Backup. Lock ownership is left out unless withLocks is
+// set.
+func (d *DataStore) Backup(withLocks bool, fn func(*EntryState) error) error {
+	r := &KeyRange{}
+	for {
+		states, cursor := d.Range(r, backupPage)
+		for _, s := range states {
+			if !withLocks {
+				s = withoutLock(s)
+			}
+			if err := fn(s); err != nil {
+				return err
+			}
+		}
+
+		if cursor == "" {
+			return nil
+		}
+		r = r.After(cursor)
+	}
+}
+
+// states returns a copy of every entry, cached or not, in no particular
+// order. Expects the DataStore to be frozen.
+func (d *DataStore) states() ([]*EntryState, error) {
+	states := make([]*EntryState, 0, len(d.Entries))
+	for _, entry := range d.Entries {
+		states = append(states, entry.State())
+	}
+
+	if d.Store == nil {
+		return states, nil
+	}
+	err := d.Store.Scan("", func(s *EntryState) bool {
+		if _, cached := d.Entries[s.Key]; !cached {
+			states = append(states, s)
+		}
+		return true
+	})
+	return states, err
+}
+
+// Restore loads backed up states into the DataStore in one go. Entries in
+// the backup overwrite any with the same key. In replace mode, entries
+// that aren't in the backup are removed, otherwise they're left alone.
+// Everything applied is written to the write-ahead log as it goes.
+func (d *DataStore) Restore(states []*EntryState, replace bool) (int, int) {
+	var dropped []AcquireAction
+	removed := 0
+
+	d.Freeze(func() {
+		//Anyone waiting on a cached entry that is removed, or whose lock
+		//changes, is told it was deleted once everything is unlocked again.
+		drop := func(key string) {
+			if entry, cached := d.Entries[key]; cached {
+				dropped = append(dropped, AcquireAction{Key: key, Id: entry.LockId})
+			}
+		}
+
+		if replace {
+			keep := make(map[string]struct{}, len(states))
+			for _, s := range states {
+				keep[s.Key] = struct{}{}
+			}
+
+			stale := []string{}
+			for key := range d.Entries {
+				if _, kept := keep[key]; !kept {
+					stale = append(stale, key)
+				}
+			}
+			if d.Store != nil {
+				err := d.Store.Scan("", func(s *EntryState) bool {
+					_, kept := keep[s.Key]
+					_, cached := d.Entries[s.Key]
+					if !kept && !cached {
+						stale = append(stale, s.Key)
+					}
+					return true
+				})
+				if err != nil {
+					logger.Error(err)
+				}
+			}
+
+			for _, key := range stale {
+				drop(key)
+				d.unload(key)
+				logDelete(key)
+				removed++
+			}
+		}
+
+		for _, s := range states {
+			//An entry that keeps its lock is updated in place, so the
+			//holder and anyone waiting on it are left be.
+			if entry, cached := d.Entries[s.Key]; cached && entry.LockId == s.LockId {
+				entry.apply(s)
+				d.expiries.Set(s.Key, entry.Expires)
+				d.writeBack(entry)
+			} else {
+				drop(s.Key)
+				d.load(s)
+			}
+			logState(s)
+		}
+	})
+
+	for _, a := range dropped {
+		if a.Id != "" {
+			locks.DeleteLock(a.Id)
+		}
+		deleteEntry <- AcquireAction{Key: a.Key}
+	}
+
+	return len(states), removed
+}
+
+func backupData(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /admin/backup, request id: %s", random.String(5))
+
+	//Locks are left out unless asked for, as they are from the change
+	//feed, since a lock id is as good as the lock.
+	withLocks := r.URL.Query().Get("locks") == "true"
+
+	snap := &Snapshot{Time: time.Now(), Rev: changes.Seq()}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"httpdb-%s.snap\"", snap.Time.Format("20060102-150405")))
+	w.WriteHeader(http.StatusOK)
+
+	//The status is already sent, so a backup cut short by an error is
+	//only told apart by its missing end, which restoring it catches.
+	s, err := NewSnapshotWriter(w, snap)
+	if err == nil {
+		err = data.Backup(withLocks, s.Write)
+	}
+	if err == nil {
+		err = s.Close()
+	}
+	if err != nil {
+		logger.Errorf("Error writing backup: %s", err)
+		return
+	}
+	logger.Infof("Handled successful backup of %d entries.", s.Count())
+}
+
+func restoreData(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /admin/restore, request id: %s", random.String(5))
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = RestoreMerge
+	}
+	if mode != RestoreMerge && mode != RestoreReplace {
+		logger.Infof("Invalid request, unknown restore mode: %s", mode)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	snap, err := DecodeSnapshot(r.Body, "request body")
+	if err != nil {
+		logger.Infof("Invalid request, bad backup: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, s := range snap.Entries {
+		if s == nil || s.Key == "" {
+			logger.Info("Invalid request, backup has an entry with no key.")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	restored, removed := data.Restore(snap.Entries, mode == RestoreReplace)
+
+	j, err := json.Marshal(map[string]int{"restored": restored, "removed": removed})
+	if err != nil {
+		logger.Errorf("Error marshaling restore counts to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful %s restore of %d entries from backup taken: %s", mode, restored, snap.Time)
+}
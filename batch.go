@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+// batchMax is the most keys a single batch request can name.
+const batchMax = 1000
+
+// BatchGetRequest is the body of POST /batch/get.
+type BatchGetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// BatchPut is one write in a batch. With a LockId it is the same as
+// POST /values/{key}/{lock_id}, without one the same as PUT /values/{key}.
+type BatchPut struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	LockId  string `json:"lock_id,omitempty"`
+	Release bool   `json:"release,omitempty"`
+}
+
+// BatchPutRequest is the body of POST /batch/put.
+type BatchPutRequest struct {
+	Items []*BatchPut `json:"items"`
+}
+
+// BatchResult is the outcome for one key. Status is the HTTP status code
+// the same request for just that key would have got.
+type BatchResult struct {
+	Key      string  `json:"key"`
+	Status   int     `json:"status"`
+	Value    *string `json:"value,omitempty"`
+	Revision int64   `json:"revision,omitempty"`
+	LockId   string  `json:"lock_id,omitempty"`
+}
+
+// batchEntry looks up the entry for one key of a batch, or returns the
+// status saying why it can't.
+func batchEntry(key string) (*Entry, int) {
+	if key == "" {
+		logger.Info("Invalid batch item, no key specified.")
+		return nil, http.StatusBadRequest
+	}
+
+	//A batch can't be routed as a whole, so keys held elsewhere are
+	//turned away one by one.
+	if shards != nil {
+		ring, _ := shards.Rings()
+		if owner := ring.Owner(key); owner != shards.Id {
+			logger.Infof("Invalid batch item, key '%s' belongs to shard: %s", key, owner)
+			return nil, http.StatusMisdirectedRequest
+		}
+	}
+
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		return nil, http.StatusNotFound
+	}
+	return entry, 0
+}
+
+func batchGet(key string) *BatchResult {
+	entry, status := batchEntry(key)
+	if entry == nil {
+		if status == http.StatusNotFound {
+			logger.Infof("Invalid batch item, entry key not found: %s", key)
+		}
+		return &BatchResult{Key: key, Status: status}
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid batch item, entry is not a string value: %s", key)
+		return &BatchResult{Key: key, Status: http.StatusConflict}
+	}
+
+	value := entry.GetValue()
+	return &BatchResult{Key: key, Status: http.StatusOK, Value: &value, Revision: entry.GetRevision()}
+}
+
+// batchUpdate writes to an entry the caller has already reserved.
+func batchUpdate(item *BatchPut) *BatchResult {
+	entry, status := batchEntry(item.Key)
+	if entry == nil {
+		if status == http.StatusNotFound {
+			logger.Infof("Invalid batch item, entry key not found: %s", item.Key)
+		}
+		return &BatchResult{Key: item.Key, Status: status}
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid batch item, entry is not a string value: %s", item.Key)
+		return &BatchResult{Key: item.Key, Status: http.StatusConflict}
+	}
+
+	if !entry.ValidLock(item.LockId) {
+		logger.Debugf("LockId does not match entry: %s - LockId: %s", item.Key, item.LockId)
+		return &BatchResult{Key: item.Key, Status: http.StatusUnauthorized}
+	}
+
+	entry.SetValue(item.Value)
+
+	if item.Release {
+		logger.Infof("Removing lock from entry: %s", item.Key)
+		entry.UnsetLockId()
+	}
+	return &BatchResult{Key: item.Key, Status: http.StatusNoContent, Revision: entry.GetRevision()}
+}
+
+// batchPut writes to an entry, creating it if needed, and reserves it
+// for the caller.
+func batchPut(item *BatchPut) *BatchResult {
+	entry, status := batchEntry(item.Key)
+	if status == http.StatusNotFound {
+		logger.Infof("Generating new entry for key: %s", item.Key)
+
+		//Didn't exist, make a new one! Someone else may have beaten us to it.
+		entry = &Entry{Key: item.Key}
+		if err := data.AddEntry(entry); err != nil {
+			logger.Debug(err)
+			entry, status = batchEntry(item.Key)
+		}
+	}
+	if entry == nil {
+		return &BatchResult{Key: item.Key, Status: status}
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid batch item, entry is not a string value: %s", item.Key)
+		return &BatchResult{Key: item.Key, Status: http.StatusConflict}
+	}
+
+	newid := newLockId()
+
+	//Check the LockId, if unlocked, set lock. If locked, acquire lock.
+	if !entry.SetLockId(newid) {
+		if err := AcquireLock(entry, time.Second*Config.App.TimeOut, newid); err != nil {
+			logger.Info(err)
+			return &BatchResult{Key: item.Key, Status: http.StatusRequestTimeout}
+		}
+	}
+
+	entry.SetValue(item.Value)
+	return &BatchResult{Key: item.Key, Status: http.StatusOK, Revision: entry.GetRevision(), LockId: newid}
+}
+
+func writeBatchResults(w http.ResponseWriter, results []*BatchResult) {
+	j, err := json.Marshal(map[string][]*BatchResult{"results": results})
+	if err != nil {
+		logger.Errorf("Error marshaling batch results to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+}
+
+func batchGetValues(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /batch/get, request id: %s", random.String(5))
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("Error occured reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	req := &BatchGetRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		logger.Infof("Invalid request, bad batch json: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(req.Keys) > batchMax {
+		logger.Infof("Invalid request, batch of %d keys is over the limit of %d.", len(req.Keys), batchMax)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]*BatchResult, 0, len(req.Keys))
+	for _, key := range req.Keys {
+		results = append(results, batchGet(key))
+	}
+
+	writeBatchResults(w, results)
+	logger.Infof("Handled successful batch request for %d keys.", len(results))
+}
+
+func batchPutValues(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /batch/put, request id: %s", random.String(5))
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("Error occured reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	req := &BatchPutRequest{}
+	if err := json.Unmarshal(body, req); err != nil {
+		logger.Infof("Invalid request, bad batch json: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) > batchMax {
+		logger.Infof("Invalid request, batch of %d keys is over the limit of %d.", len(req.Items), batchMax)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	for _, item := range req.Items {
+		if item == nil {
+			logger.Info("Invalid request, batch has a null item.")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	//Items are applied in order, so later ones see what earlier ones did.
+	results := make([]*BatchResult, 0, len(req.Items))
+	for _, item := range req.Items {
+		if item.LockId != "" {
+			results = append(results, batchUpdate(item))
+		} else {
+			results = append(results, batchPut(item))
+		}
+	}
+
+	writeBatchResults(w, results)
+	logger.Infof("Handled successful batch request for %d keys.", len(results))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+// BulkRecord is one line of a bulk import or export. TTL is the number
+// of seconds until the entry expires, or zero for never.
+type BulkRecord struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	TTL         int64  `json:"ttl,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// ReadBulk parses one JSON object per line. Blank lines are skipped.
+func ReadBulk(r io.Reader) ([]*BulkRecord, error) {
+	records := []*BulkRecord{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		rec := &BulkRecord{}
+		if err := json.Unmarshal(text, rec); err != nil {
+			return nil, fmt.Errorf("Unable to parse line %d: %s", line, err)
+		}
+		if rec.Key == "" {
+			return nil, fmt.Errorf("Line %d has no key.", line)
+		}
+		if rec.TTL < 0 {
+			return nil, fmt.Errorf("Line %d has a negative ttl.", line)
+		}
+		records = append(records, rec)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read bulk records: %s", err)
+	}
+	return records, nil
+}
+
+// Import sets every record's value, content type and expiry in a single
+// pass, with the DataStore frozen throughout, creating entries as needed.
+// Keys that are locked or hold something other than a string value are
+// skipped and returned.
+func (d *DataStore) Import(records []*BulkRecord) (int, []string) {
+	imported := 0
+	skipped := []string{}
+	now := time.Now()
+
+	d.Freeze(func() {
+		for _, rec := range records {
+			entry, err := d.lookup(rec.Key)
+			if err != nil {
+				entry = &Entry{Key: rec.Key, used: time.Now()}
+				d.add(entry)
+			}
+
+			if entry.IsLocked() || !entry.IsType(StringEntry) {
+				skipped = append(skipped, rec.Key)
+				continue
+			}
+
+			var expires time.Time
+			if rec.TTL > 0 {
+				expires = now.Add(time.Second * time.Duration(rec.TTL))
+			}
+			entry.ContentType = rec.ContentType
+			d.setExpiry(entry, expires)
+			d.setValue(entry, rec.Value)
+			imported++
+		}
+	})
+
+	return imported, skipped
+}
+
+// Export calls fn with every string value in key order, each as it is
+// when it is reached, until fn returns an error. The ttl is rounded up to
+// the next second, and entries that have already expired are left out.
+func (d *DataStore) Export(fn func(*BulkRecord) error) error {
+	return d.Backup(false, func(s *EntryState) error {
+		if s.Type != "" && s.Type != StringEntry {
+			return nil
+		}
+
+		rec := &BulkRecord{Key: s.Key, Value: s.Value, ContentType: s.ContentType}
+		if s.Expires != nil {
+			left := time.Until(*s.Expires)
+			if left <= 0 {
+				return nil
+			}
+			rec.TTL = int64((left + time.Second - 1) / time.Second)
+		}
+		return fn(rec)
+	})
+}
+
+func exportValues(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /bulk/export, request id: %s", random.String(5))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	//Each record is sent as it's read. The status is already sent, so an
+	//export cut short by an error just ends early.
+	enc := json.NewEncoder(w)
+	count := 0
+	err := data.Export(func(rec *BulkRecord) error {
+		count++
+		return enc.Encode(rec)
+	})
+	if err != nil {
+		logger.Errorf("Error writing export: %s", err)
+		return
+	}
+	logger.Infof("Handled successful export of %d values.", count)
+}
+
+func importValues(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /bulk/import, request id: %s", random.String(5))
+
+	records, err := ReadBulk(r.Body)
+	if err != nil {
+		logger.Infof("Invalid request, bad import: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	imported, skipped := data.Import(records)
+
+	j, err := json.Marshal(map[string]interface{}{"imported": imported, "skipped": skipped})
+	if err != nil {
+		logger.Errorf("Error marshaling import results to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful import of %d values, skipped %d.", imported, len(skipped))
+}
+
+// runCommand handles the import and export subcommands, which send a
+// file, or stdin/stdout if none is given, to a running server.
+func runCommand(args []string) error {
+	server := serverUrl
+	if server == "" {
+		server = fmt.Sprintf("http://localhost:%d", Config.App.Port)
+	}
+
+	switch args[0] {
+	case "import":
+		in := io.Reader(os.Stdin)
+		if len(args) > 1 && args[1] != "-" {
+			file, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+
+		resp, err := http.Post(server+"/bulk/import", "application/x-ndjson", in)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Import failed: %s", resp.Status)
+		}
+		fmt.Println(string(body))
+		return nil
+
+	case "export":
+		out := io.Writer(os.Stdout)
+		if len(args) > 1 && args[1] != "-" {
+			file, err := os.Create(args[1])
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+
+		resp, err := http.Get(server + "/bulk/export")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Export failed: %s", resp.Status)
+		}
+		_, err = io.Copy(out, resp.Body)
+		return err
+	}
+
+	return fmt.Errorf("Unknown command: %s", args[0])
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/btnmasher/random"
+)
+
+// ChangeLog keeps the most recent changes in memory for followers and
+// readers of the change feed to catch up from. Every change gets the next
+// revision, and revisions carry on across restarts through the write-ahead
+// log and snapshots. A follower's copy of the data only matches the
+// process it came from though, so each ChangeLog also gets a random epoch.
+type ChangeLog struct {
+	sync.Mutex
+	Epoch   string
+	changes []*WALRecord
+	seq     int64
+	size    int
+	wake    chan struct{}
+}
+
+func NewChangeLog(size int) *ChangeLog {
+	return &ChangeLog{
+		Epoch: random.String(16),
+		size:  size,
+		wake:  make(chan struct{}),
+	}
+}
+
+// Append keeps a copy of rec under the next revision, and returns it.
+func (c *ChangeLog) Append(rec *WALRecord) int64 {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.seq++
+	c.keep(rec, c.seq)
+	return c.seq
+}
+
+// Replay keeps a change read back from the write-ahead log under the
+// revision it was first made with.
+func (c *ChangeLog) Replay(rec *WALRecord) {
+	if c == nil || rec.Rev <= c.seq {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	//Lock changes aren't always persisted, so there can be gaps.
+	c.seq = rec.Rev
+	c.keep(rec, rec.Rev)
+}
+
+// Observe moves the revision up to rev, for changes that are already
+// accounted for elsewhere, like in a snapshot.
+func (c *ChangeLog) Observe(rev int64) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if rev > c.seq {
+		c.seq = rev
+		c.changes = nil
+	}
+}
+
+func (c *ChangeLog) keep(rec *WALRecord, rev int64) {
+	change := *rec
+	change.Rev = rev
+	c.changes = append(c.changes, &change)
+	if over := len(c.changes) - c.size; over > 0 {
+		c.changes = c.changes[over:]
+	}
+
+	//Wake everyone waiting on the next change.
+	close(c.wake)
+	c.wake = make(chan struct{})
+}
+
+func (c *ChangeLog) Seq() int64 {
+	if c == nil {
+		return 0
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.seq
+}
+
+// Since returns the changes made after seq, and a channel that is closed
+// when the next one is made. If changes after seq have already been
+// dropped, or seq is from the future, ok is false and the caller has to
+// start over from a full copy.
+func (c *ChangeLog) Since(seq int64) (changes []*WALRecord, wake <-chan struct{}, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if seq > c.seq {
+		return nil, c.wake, false
+	}
+
+	if len(c.changes) > 0 && seq < c.changes[0].Rev-1 {
+		return nil, c.wake, false
+	}
+
+	if len(c.changes) == 0 && seq < c.seq {
+		return nil, c.wake, false
+	}
+
+	first := sort.Search(len(c.changes), func(i int) bool { return c.changes[i].Rev > seq })
+	return append([]*WALRecord{}, c.changes[first:]...), c.wake, true
+}
+
+// changesPage is the most changes handed out by a single request.
+const changesPage = 1000
+
+func getChanges(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /changes, request id: %s", random.String(5))
+
+	query := r.URL.Query()
+
+	var since int64
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			logger.Infof("Invalid request, bad revision: %s", v)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := changesPage
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			logger.Infof("Invalid request, bad limit: %s", v)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if limit > changesPage {
+			limit = changesPage
+		}
+	}
+
+	if changes == nil {
+		logger.Info("Invalid request, no change log is kept.")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	pending, _, ok := changes.Since(since)
+	if !ok {
+		logger.Infof("Invalid request, changes since revision %d are no longer kept.", since)
+		j, _ := json.Marshal(map[string]int64{"rev": changes.Seq()})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGone)
+		w.Write(j)
+		return
+	}
+
+	//Lock ids are as good as the lock, so they never leave in the feed.
+	rev := since
+	feed := make([]*WALRecord, 0, len(pending))
+	for _, change := range pending {
+		if len(feed) == limit {
+			break
+		}
+		c := *change
+		c.Entry = withoutLock(c.Entry)
+		feed = append(feed, &c)
+		rev = c.Rev
+	}
+
+	body := map[string]interface{}{"rev": rev, "more": len(feed) < len(pending), "changes": feed}
+
+	j, err := json.Marshal(body)
+	if err != nil {
+		logger.Errorf("Error marshaling changes to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for %d changes since revision %d.", len(feed), since)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+// forwardedHeader marks a request one node has already passed on to the
+// leader, so it is never passed on twice.
+const forwardedHeader = "X-Httpdb-Forwarded"
+
+// cluster is set when this node is part of a Raft cluster. Every change
+// is then proposed to the cluster's log as it is made, every other node
+// applies it once committed, and requests are only served by the leader.
+var cluster *RaftNode
+
+func loadCluster() {
+	if Config.App.ClusterId == "" {
+		return
+	}
+
+	peers := make(map[string]string)
+	for id, addr := range Config.App.ClusterPeers {
+		if id != Config.App.ClusterId {
+			peers[id] = strings.TrimRight(addr, "/")
+		}
+	}
+
+	node, err := NewRaftNode(Config.App.ClusterId, peers, Config.App.RaftPath, clusterApply, clusterReset)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	cluster = node
+
+	logger.Infof("Joined cluster as %s with %d peers, data will be rebuilt from the raft log: %s", node.Id, len(peers), Config.App.RaftPath)
+}
+
+// clusterApply applies a committed record from another node.
+func clusterApply(rec *WALRecord) {
+	data.apply(rec)
+	logLocal(rec)
+}
+
+// clusterReset empties the DataStore and loads the states from the raft
+// snapshot, so the committed log after it can be applied on top.
+func clusterReset(states []*EntryState) {
+	data.Freeze(func() {
+		keys := []string{}
+		for key := range data.Entries {
+			keys = append(keys, key)
+		}
+		if data.Store != nil {
+			data.Store.Keys(&KeyRange{}, func(key string) bool {
+				keys = append(keys, key)
+				return true
+			})
+		}
+		for _, key := range keys {
+			data.unload(key)
+		}
+		for _, s := range states {
+			data.load(s)
+		}
+	})
+
+	for _, s := range states {
+		logLocal(&WALRecord{Op: "put", Event: EventPut, Key: s.Key, Entry: s})
+	}
+}
+
+// clusterSnapshot compacts the raft log behind a snapshot of the data,
+// taken with every change held off so it matches the log exactly.
+func clusterSnapshot() error {
+	var index, term int64
+	var states []*EntryState
+	var err error
+
+	data.Freeze(func() {
+		if index, term = cluster.SnapshotPoint(); index > 0 {
+			states, err = data.states()
+		}
+	})
+	if index == 0 || err != nil {
+		return err
+	}
+
+	return cluster.Compact(index, term, states, time.Second*Config.App.TimeOut)
+}
+
+// bufferedResponse holds a handler's response back until the cluster
+// has committed everything it depends on.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+// clusterRoute sends requests to the leader from every other node, and
+// on the leader holds each response back until it is safely committed.
+func clusterRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cluster == nil || strings.HasPrefix(r.URL.Path, "/raft/") || r.URL.Path == "/cluster/status" || nodeLocal(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := time.Second * Config.App.TimeOut
+		start := time.Now()
+
+		state, _, leader := cluster.Status()
+		if state != RaftLeader {
+			target, err := url.Parse(cluster.PeerUrl(leader))
+			if leader == "" || err != nil || r.Header.Get(forwardedHeader) != "" {
+				logger.Infof("Unable to serve %s request for %s, no leader to forward it to.", r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+
+			logger.Debugf("Forwarding %s request for %s to leader: %s", r.Method, r.URL.Path, leader)
+			r.Header.Set(forwardedHeader, cluster.Id)
+			httputil.NewSingleHostReverseProxy(target).ServeHTTP(w, r)
+			return
+		}
+
+		//Streams never finish, so they can't be held back.
+		if streaming(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := cluster.Ready(timeout); err != nil {
+			logger.Infof("Unable to serve %s request for %s: %s", r.Method, r.URL.Path, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		buf := &bufferedResponse{header: make(http.Header)}
+		next.ServeHTTP(buf, r)
+
+		if err := cluster.Barrier(start, timeout); err != nil {
+			logger.Warnf("Dropping response to %s request for %s: %s", r.Method, r.URL.Path, err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		for key, values := range buf.header {
+			w.Header()[key] = values
+		}
+		if buf.code != 0 {
+			w.WriteHeader(buf.code)
+		}
+		w.Write(buf.body.Bytes())
+	})
+}
+
+// streaming is whether r is for a response that is sent as it goes.
+// Sessions hold each of their replies back themselves.
+func streaming(r *http.Request) bool {
+	return r.URL.Path == "/watch" || r.URL.Path == "/replication/stream" || r.URL.Path == "/sessions"
+}
+
+func raftRpc(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	cluster.ServeHTTP(w, r)
+}
+
+func getClusterStatus(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /cluster/status, request id: %s", random.String(5))
+
+	if cluster == nil {
+		logger.Info("Invalid request, not part of a cluster.")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	state, term, leader := cluster.Status()
+
+	j, err := json.Marshal(map[string]interface{}{"id": cluster.Id, "state": state, "term": term, "leader": leader})
+	if err != nil {
+		logger.Errorf("Error marshaling cluster status to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Info("Handled successful request for cluster status.")
+}
+
+func startCluster(stop chan struct{}) {
+	logger.Info("Started Raft Gouroutine.")
+	cluster.Run(stop)
+	logger.Info("Stopped Raft Goroutine.")
+}
+
+// startRaftSnapshotter compacts the raft log once enough entries have
+// built up since the last snapshot.
+func startRaftSnapshotter(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	logger.Info("Started Raft Snapshotter Gouroutine.")
+	for {
+		select {
+
+		case <-ticker.C:
+			if cluster.LogSize() < Config.App.RaftSnapshot {
+				continue
+			}
+			if err := clusterSnapshot(); err != nil {
+				logger.Warnf("Unable to snapshot the raft log: %s", err)
+			}
+
+		case <-stop:
+			logger.Info("Stopped Raft Snapshotter Goroutine.")
+			return
+
+		}
+	}
+}
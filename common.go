@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/btnmasher/random"
@@ -41,3 +42,12 @@ func newLockId() string {
 
 	return newid
 }
+
+// validLockQuery checks the optional lock_id query value against the entry.
+// An unlocked entry accepts any request, a locked one only its own LockId.
+func validLockQuery(entry *Entry, r *http.Request) bool {
+	if !entry.IsLocked() {
+		return true
+	}
+	return entry.ValidLock(r.FormValue("lock_id"))
+}
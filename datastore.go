@@ -2,28 +2,35 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 )
 
 type DataStore struct {
 	sync.Mutex
 	Entries map[string]*Entry
+	Store   Store
+
+	index *KeyIndex //Built on first use by ordered().
+
+	expiries Expiries
 }
 
 func (d *DataStore) EntryExists(key string) bool {
 	d.Lock()
 	defer d.Unlock()
-	_, exists := d.Entries[key]
-	return exists
+	return d.has(key)
 }
 
 func (d *DataStore) AddEntry(entry *Entry) error {
 	d.Lock()
 	defer d.Unlock()
-	if _, exists := d.Entries[entry.Key]; exists {
+	if d.has(entry.Key) {
 		return fmt.Errorf("Cannot add entry '%s', key already exists.", entry.Key)
 	} else {
-		d.Entries[entry.Key] = entry
+		d.add(entry)
+		entry.logPut()
+		d.writeBack(entry)
 		return nil
 	}
 }
@@ -31,11 +38,13 @@ func (d *DataStore) AddEntry(entry *Entry) error {
 func (d *DataStore) NewEntry(key string) (*Entry, error) {
 	d.Lock()
 	defer d.Unlock()
-	if _, exists := d.Entries[key]; exists {
+	if d.has(key) {
 		return nil, fmt.Errorf("Cannot create new entry '%s', key already exists.", key)
 	} else {
 		entry := &Entry{Key: key}
-		d.Entries[entry.Key] = entry
+		d.add(entry)
+		entry.logPut()
+		d.writeBack(entry)
 		return entry, nil
 	}
 }
@@ -43,20 +52,143 @@ func (d *DataStore) NewEntry(key string) (*Entry, error) {
 func (d *DataStore) GetEntry(key string) (*Entry, error) {
 	d.Lock()
 	defer d.Unlock()
-	if _, exists := d.Entries[key]; !exists {
-		return nil, fmt.Errorf("Cannot get entry '%s', does not exist.", key)
-	} else {
-		return d.Entries[key], nil
+	return d.lookup(key)
+}
+
+// States returns the persisted form of every entry. Each entry is locked
+// only while it is being copied.
+func (d *DataStore) States() []*EntryState {
+	d.Lock()
+	entries := make(map[string]*Entry, len(d.Entries))
+	for key, entry := range d.Entries {
+		entries[key] = entry
+	}
+	d.Unlock()
+
+	states := make([]*EntryState, 0, len(entries))
+	for _, entry := range entries {
+		entry.Lock()
+		states = append(states, entry.State())
+		entry.Unlock()
+	}
+
+	//Anything not cached is already in its stored form.
+	if d.Store != nil {
+		err := d.Store.Scan("", func(s *EntryState) bool {
+			if _, cached := entries[s.Key]; !cached {
+				states = append(states, s)
+			}
+			return true
+		})
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+
+	return states
+}
+
+// Freeze runs fn with the DataStore and every cached entry locked, so
+// nothing can change while fn works on the data set as a whole. Entries
+// are locked before the DataStore, the same order everything else uses,
+// and if new ones were cached in the meantime it starts over. fn has to
+// stick to the methods that expect the DataStore lock to be held.
+func (d *DataStore) Freeze(fn func()) {
+	for {
+		d.Lock()
+		entries := make([]*Entry, 0, len(d.Entries))
+		for _, entry := range d.Entries {
+			entries = append(entries, entry)
+		}
+		d.Unlock()
+
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+		for _, entry := range entries {
+			entry.Lock()
+		}
+		d.Lock()
+
+		settled := len(d.Entries) == len(entries)
+		for _, entry := range entries {
+			if d.Entries[entry.Key] != entry {
+				settled = false
+				break
+			}
+		}
+
+		if settled {
+			fn()
+		}
+
+		d.Unlock()
+		for _, entry := range entries {
+			entry.Unlock()
+		}
+
+		if settled {
+			return
+		}
+	}
+}
+
+// Hold runs fn with the DataStore and the entries for keys locked, the
+// same way Freeze does for every entry. fn is given the entries that
+// exist; it can add the missing ones, but the same rules as Freeze apply.
+func (d *DataStore) Hold(keys []string, fn func(entries map[string]*Entry)) {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+
+	for {
+		d.Lock()
+		entries := make(map[string]*Entry)
+		for _, key := range sorted {
+			if entry, err := d.lookup(key); err == nil {
+				entries[key] = entry
+			}
+		}
+		d.Unlock()
+
+		held := []*Entry{}
+		for i, key := range sorted {
+			if entry, exists := entries[key]; exists && (i == 0 || key != sorted[i-1]) {
+				entry.Lock()
+				held = append(held, entry)
+			}
+		}
+		d.Lock()
+
+		settled := true
+		for _, key := range sorted {
+			if d.Entries[key] != entries[key] {
+				settled = false
+				break
+			}
+		}
+
+		if settled {
+			fn(entries)
+		}
+
+		d.Unlock()
+		for _, entry := range held {
+			entry.Unlock()
+		}
+
+		if settled {
+			return
+		}
 	}
 }
 
 func (d *DataStore) DeleteEntry(key string) error {
 	d.Lock()
 	defer d.Unlock()
-	if entry, exists := d.Entries[key]; !exists {
+	if entry, err := d.lookup(key); err != nil {
 		return fmt.Errorf("Cannot delete entry '%s', does not exist.", key)
 	} else {
-		delete(d.Entries, key)
+		d.unload(key)
+		logDelete(key)
 		locks.DeleteLock(entry.GetLockId())
 		deleteEntry <- AcquireAction{Key: key}
 		return nil
@@ -3,13 +3,49 @@ package main
 import (
 	"encoding/json"
 	"sync"
+	"time"
+)
+
+type EntryType string
+
+const (
+	StringEntry EntryType = "string"
+	HashEntry   EntryType = "hash"
+	SetEntry    EntryType = "set"
+	ZSetEntry   EntryType = "zset"
+	QueueEntry  EntryType = "queue"
 )
 
 type Entry struct {
 	sync.Mutex
-	Key    string `json:"-"`
-	Value  string `json:"value"`
-	LockId string `json:"lock_id"`
+	Key      string            `json:"-"`
+	Type     EntryType         `json:"type,omitempty"`
+	Value    string            `json:"value"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Members  []string          `json:"members,omitempty"`
+	Scores   []ScoredMember    `json:"scores,omitempty"`
+	Messages []*QueueMessage   `json:"messages,omitempty"`
+	LockId   string            `json:"lock_id"`
+	Revision int64             `json:"revision,omitempty"`
+	History  []Revision        `json:"-"`
+
+	ContentType string    `json:"content_type,omitempty"`
+	Expires     time.Time `json:"-"` //Zero for never.
+
+	used time.Time //Last lookup, guarded by the DataStore lock.
+}
+
+func (e *Entry) GetType() EntryType {
+	// e.Lock()
+	// defer e.Unlock()
+	if e.Type == "" {
+		return StringEntry
+	}
+	return e.Type
+}
+
+func (e *Entry) IsType(t EntryType) bool {
+	return e.GetType() == t
 }
 
 func (e *Entry) IsLocked() bool {
@@ -40,6 +76,7 @@ func (e *Entry) SetLockId(id string) bool {
 		return false
 	} else {
 		e.LockId = id
+		e.logLock()
 		return true
 	}
 }
@@ -91,6 +128,7 @@ func (e *Entry) UnsetLockId() {
 	// defer e.Unlock()
 	locks.DeleteLock(e.LockId)
 	e.LockId = ""
+	e.logLock()
 	releaseLock <- AcquireAction{Key: e.Key}
 }
 
@@ -136,6 +174,9 @@ func (e *Entry) SetValue(value string) {
 	// e.Lock()
 	// defer e.Unlock()
 	e.Value = value
+	e.Revision++
+	e.addHistory(Revision{Revision: e.Revision, Value: value, Time: time.Now()})
+	e.commit()
 }
 
 func (e *Entry) SetValueAtomic(value string) {
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expirySweep is how often entries are checked for having expired.
+const expirySweep = time.Second / 10
+
+type expiryItem struct {
+	key string
+	at  time.Time
+}
+
+type expiryQueue []expiryItem
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiryItem)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// Expiries is when each entry with an expiry is due, cached or not. It is
+// guarded by the DataStore lock. Deadlines are queued in order, and ones
+// that were changed or cleared since are skipped when they come up.
+type Expiries struct {
+	deadlines map[string]time.Time
+	queue     expiryQueue
+}
+
+// Set changes when key expires, with a zero time for never.
+func (x *Expiries) Set(key string, at time.Time) {
+	if at.IsZero() {
+		delete(x.deadlines, key)
+		return
+	}
+	if x.deadlines == nil {
+		x.deadlines = make(map[string]time.Time)
+	}
+	if old, exists := x.deadlines[key]; exists && old.Equal(at) {
+		return
+	}
+	x.deadlines[key] = at
+	heap.Push(&x.queue, expiryItem{key: key, at: at})
+}
+
+// Due returns the keys whose deadlines have passed, and forgets them.
+func (x *Expiries) Due(now time.Time) []string {
+	keys := []string{}
+	for len(x.queue) > 0 && !x.queue[0].at.After(now) {
+		item := heap.Pop(&x.queue).(expiryItem)
+		if at, exists := x.deadlines[item.key]; exists && at.Equal(item.at) {
+			delete(x.deadlines, item.key)
+			keys = append(keys, item.key)
+		}
+	}
+	return keys
+}
+
+// SetExpiry sets when the entry is deleted, with a zero time for never.
+// The entry must be locked.
+func (e *Entry) SetExpiry(at time.Time) {
+	data.Lock()
+	if data.Entries[e.Key] == e {
+		data.setExpiry(e, at)
+	}
+	data.Unlock()
+	e.commit()
+}
+
+// setExpiry is the same as SetExpiry, for when the DataStore lock is
+// already held, minus persisting it. The entry must be locked too.
+func (d *DataStore) setExpiry(entry *Entry, at time.Time) {
+	entry.Expires = at
+	d.expiries.Set(entry.Key, at)
+}
+
+// ExpireEntries deletes every entry that has expired by now, locked or
+// not, and returns how many. Anyone waiting to reserve one is told.
+func (d *DataStore) ExpireEntries(now time.Time) int {
+	d.Lock()
+	due := d.expiries.Due(now)
+	d.Unlock()
+
+	count := 0
+	for _, key := range due {
+		expired := false
+		lockId := ""
+
+		d.Hold([]string{key}, func(entries map[string]*Entry) {
+			//It may have been deleted, or given a new expiry, since.
+			entry, exists := entries[key]
+			if !exists || entry.Expires.IsZero() || entry.Expires.After(now) {
+				return
+			}
+			lockId = entry.LockId
+			d.unload(key)
+			logDelete(key)
+			expired = true
+		})
+
+		if expired {
+			if lockId != "" {
+				locks.DeleteLock(lockId)
+			}
+			deleteEntry <- AcquireAction{Key: key}
+			count++
+		}
+	}
+	return count
+}
+
+// loadExpiries finds the entries with an expiry in the Store, which are
+// only otherwise known about once they are read in.
+func loadExpiries() {
+	data.Lock()
+	defer data.Unlock()
+
+	err := data.Store.Scan("", func(s *EntryState) bool {
+		data.expiries.Set(s.Key, s.expiry())
+		return true
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+}
+
+// startEntryExpirer deletes expired entries, as long as this node is the
+// one taking writes. Anywhere else the deletions arrive with the rest of
+// the changes.
+func startEntryExpirer(stop chan struct{}) {
+	ticker := time.NewTicker(expirySweep)
+	defer ticker.Stop()
+
+	logger.Info("Started Entry Expirer Gouroutine.")
+	for {
+		select {
+
+		case now := <-ticker.C:
+			if !acceptsWrites() {
+				continue
+			}
+			if count := data.ExpireEntries(now); count > 0 {
+				logger.Infof("Deleted %d expired entries.", count)
+			}
+
+		case <-stop:
+			logger.Info("Stopped Entry Expirer Goroutine.")
+			return
+
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// fileScanBatch is how many records a scan reads per transaction.
+const fileScanBatch = 256
+
+var fileBucket = []byte("entries")
+
+// FileStore is a Store kept in a single file as a B+tree, with bbolt.
+// Records are kept in key order on disk and only the pages in use are
+// paged in, so neither the keys nor the values have to fit in RAM, and a
+// scan only reads the part of the tree it covers. Pages freed by
+// overwrites and deletes are reused rather than compacted away.
+type FileStore struct {
+	sync.Mutex
+	db       *bolt.DB
+	path     string
+	policy   string
+	lastSync time.Time
+}
+
+func OpenFileStore(path, policy string) (*FileStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open file store: %s", err)
+	}
+
+	//Without a sync on every commit, the interval policy syncs by hand.
+	db.NoSync = policy != FsyncAlways
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(fileBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to open file store: %s", err)
+	}
+
+	return &FileStore{db: db, path: path, policy: policy}, nil
+}
+
+func (f *FileStore) Get(key string) (*EntryState, bool, error) {
+	var s *EntryState
+	err := f.db.View(func(tx *bolt.Tx) error {
+		record := tx.Bucket(fileBucket).Get([]byte(key))
+		if record == nil {
+			return nil
+		}
+		s = &EntryState{}
+		return json.Unmarshal(record, s)
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to read file store record '%s': %s", key, err)
+	}
+	return s, s != nil, nil
+}
+
+func (f *FileStore) Put(s *EntryState) error {
+	record, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal file store record: %s", err)
+	}
+
+	err = f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileBucket).Put([]byte(s.Key), record)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to write file store record: %s", err)
+	}
+	return f.synced()
+}
+
+func (f *FileStore) Delete(key string) error {
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileBucket).Delete([]byte(key))
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to delete file store record: %s", err)
+	}
+	return f.synced()
+}
+
+// Scan calls fn for each record with a key at or after start, in
+// ascending order, until fn returns false.
+func (f *FileStore) Scan(start string, fn func(*EntryState) bool) error {
+	var err error
+	walkErr := f.walk(&KeyRange{Start: start}, true, func(key string, record []byte) bool {
+		s := &EntryState{}
+		if err = json.Unmarshal(record, s); err != nil {
+			err = fmt.Errorf("Unable to parse file store record '%s': %s", key, err)
+			return false
+		}
+		return fn(s)
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	return err
+}
+
+// Keys calls fn for each key in the range, in its order, until fn
+// returns false, without reading the records.
+func (f *FileStore) Keys(r *KeyRange, fn func(key string) bool) error {
+	return f.walk(r, false, func(key string, record []byte) bool {
+		return fn(key)
+	})
+}
+
+// walk goes over the range fileScanBatch records at a time, each batch
+// read in its own transaction. No transaction is open while fn runs, so
+// fn is free to use the store; records changed in the meantime are seen
+// as they are when their batch is read.
+func (f *FileStore) walk(r *KeyRange, values bool, fn func(key string, record []byte) bool) error {
+	type item struct {
+		key    string
+		record []byte
+	}
+
+	after := ""
+	for {
+		batch := make([]item, 0, fileScanBatch)
+		err := f.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(fileBucket).Cursor()
+			k, v := f.seek(c, r, after)
+			for ; k != nil && len(batch) < fileScanBatch; k, v = f.step(c, r) {
+				if !f.within(r, string(k)) {
+					break
+				}
+				i := item{key: string(k)}
+				if values {
+					i.record = append([]byte(nil), v...)
+				}
+				batch = append(batch, i)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to scan file store: %s", err)
+		}
+
+		for _, i := range batch {
+			if !fn(i.key, i.record) {
+				return nil
+			}
+		}
+		if len(batch) < fileScanBatch {
+			return nil
+		}
+		after = batch[len(batch)-1].key
+	}
+}
+
+// seek moves the cursor to the first record of the range in its order,
+// or the first one past after if a batch was already read.
+func (f *FileStore) seek(c *bolt.Cursor, r *KeyRange, after string) ([]byte, []byte) {
+	if !r.Reverse {
+		from, exclusive := r.Start, r.StartExclusive
+		if after != "" {
+			from, exclusive = after, true
+		}
+		k, v := c.Seek([]byte(from))
+		if exclusive && k != nil && string(k) == from {
+			k, v = c.Next()
+		}
+		return k, v
+	}
+
+	to, inclusive := r.End, r.EndInclusive
+	if after != "" {
+		to, inclusive = after, false
+	}
+	if to == "" {
+		return c.Last()
+	}
+	k, v := c.Seek([]byte(to))
+	if k == nil {
+		return c.Last()
+	}
+	if string(k) > to || !inclusive {
+		return c.Prev()
+	}
+	return k, v
+}
+
+func (f *FileStore) step(c *bolt.Cursor, r *KeyRange) ([]byte, []byte) {
+	if r.Reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+// within is whether a key the cursor reached, going in the range's
+// order, is still inside it.
+func (f *FileStore) within(r *KeyRange, key string) bool {
+	if r.Reverse {
+		return key > r.Start || (key == r.Start && !r.StartExclusive)
+	}
+	return r.End == "" || key < r.End || (key == r.End && r.EndInclusive)
+}
+
+func (f *FileStore) Len() int {
+	count := 0
+	f.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(fileBucket).Stats().KeyN
+		return nil
+	})
+	return count
+}
+
+func (f *FileStore) Close() error {
+	f.db.Sync()
+	return f.db.Close()
+}
+
+// synced syncs the file after a write, if the policy calls for it and it
+// wasn't synced by the commit itself.
+func (f *FileStore) synced() error {
+	if f.policy != FsyncInterval {
+		return nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if time.Since(f.lastSync) < time.Second {
+		return nil
+	}
+	f.lastSync = time.Now()
+	return f.db.Sync()
+}
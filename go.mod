@@ -1,11 +1,16 @@
 module github.com/btnmasher/httpdb
 
-go 1.14
+go 1.19
 
 require (
+	github.com/google/btree v1.1.3
 	github.com/gorilla/mux v1.7.4
+	github.com/gorilla/websocket v1.5.3
 	github.com/btnmasher/lumberjack v0.0.1
 	github.com/btnmasher/random v0.0.1
 	github.com/btnmasher/smallcfg v0.0.1
 	github.com/kr/pretty v0.2.0
+	go.etcd.io/bbolt v1.3.9
+	google.golang.org/grpc v1.64.1
+	google.golang.org/protobuf v1.33.0
 )
@@ -0,0 +1,374 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=module=github.com/btnmasher/httpdb --go-grpc_out=. --go-grpc_opt=module=github.com/btnmasher/httpdb httpdb.proto
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btnmasher/httpdb/httpdbpb"
+	"github.com/btnmasher/random"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// rpcServer is the HttpDB service in httpdb.proto, served with grpc-go
+// from the stubs generated into httpdbpb.
+type rpcServer struct {
+	httpdbpb.UnimplementedHttpDBServer
+}
+
+func newRPCServer() *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.MaxRecvMsgSize(wsMaxMessage),
+		grpc.UnaryInterceptor(rpcUnary),
+		grpc.StreamInterceptor(rpcStream),
+	)
+	httpdbpb.RegisterHttpDBServer(srv, &rpcServer{})
+	return srv
+}
+
+// rpcMethod is the bare name of a call, such as Get.
+func rpcMethod(fullMethod string) string {
+	return strings.TrimPrefix(fullMethod, "/"+httpdbpb.HttpDB_ServiceDesc.ServiceName+"/")
+}
+
+// rpcTimeout is how long a call can wait, on a lock or on the cluster:
+// the configured timeout, or less if the client's deadline is sooner.
+func rpcTimeout(ctx context.Context) time.Duration {
+	timeout := time.Second * Config.App.TimeOut
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	return timeout
+}
+
+// rpcUnary runs a unary call. Like any other request, in a cluster only
+// the leader serves it, and the reply waits until it is committed.
+// Followers of a replication leader only serve reads.
+func rpcUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := rpcMethod(info.FullMethod)
+	logger.Infof("Received %s call, request id: %s", method, random.String(5))
+
+	reply, err := func() (interface{}, error) {
+		if info.FullMethod != httpdbpb.HttpDB_Get_FullMethodName {
+			if leader := replica.Leader(); leader != "" {
+				return nil, status.Errorf(codes.Unavailable, "Read-only follower, send writes to the leader: %s", leader)
+			}
+		}
+
+		if cluster == nil {
+			return handler(ctx, req)
+		}
+
+		timeout := rpcTimeout(ctx)
+		start := time.Now()
+
+		if state, _, leader := cluster.Status(); state != RaftLeader {
+			return nil, status.Errorf(codes.Unavailable, "Not the cluster leader, the leader is: %s", leader)
+		}
+		if err := cluster.Ready(timeout); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "%s", err)
+		}
+
+		reply, err := handler(ctx, req)
+
+		if err := cluster.Barrier(start, timeout); err != nil {
+			logger.Warnf("Dropping reply to %s call: %s", method, err)
+			return nil, status.Errorf(codes.Unavailable, "%s", err)
+		}
+		return reply, err
+	}()
+
+	if err == nil {
+		logger.Infof("Handled successful %s call.", method)
+	}
+	return reply, err
+}
+
+func rpcStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	logger.Infof("Received %s call, request id: %s", rpcMethod(info.FullMethod), random.String(5))
+	return handler(srv, stream)
+}
+
+// rpcEntry looks up the entry a call is about, or says why it can't.
+func rpcEntry(key string) (*Entry, error) {
+	if key == "" {
+		logger.Info("Invalid call, no key specified.")
+		return nil, status.Errorf(codes.InvalidArgument, "No key specified.")
+	}
+
+	if shards != nil {
+		ring, _ := shards.Rings()
+		if owner := ring.Owner(key); owner != shards.Id {
+			logger.Infof("Invalid call, key '%s' belongs to shard: %s", key, owner)
+			return nil, status.Errorf(codes.FailedPrecondition, "Key belongs to shard %s.", owner)
+		}
+	}
+
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid call, entry key not found: %s", key)
+		return nil, status.Errorf(codes.NotFound, "Entry not found.")
+	}
+	return entry, nil
+}
+
+func (s *rpcServer) Reserve(ctx context.Context, req *httpdbpb.KeyRequest) (*httpdbpb.Value, error) {
+	entry, err := rpcEntry(req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	newid := newLockId()
+
+	//Check the LockId, if unlocked, set lock. If locked, acquire lock.
+	if !entry.SetLockId(newid) {
+		if err := AcquireLock(entry, rpcTimeout(ctx), newid); err != nil {
+			logger.Info(err)
+			return nil, status.Errorf(codes.DeadlineExceeded, "%s", err)
+		}
+	}
+
+	v := &httpdbpb.Value{Key: req.Key, LockId: newid, Revision: entry.GetRevision()}
+	if entry.IsType(StringEntry) {
+		v.Value = entry.GetValue()
+	}
+	return v, nil
+}
+
+func (s *rpcServer) Put(ctx context.Context, req *httpdbpb.PutRequest) (*httpdbpb.Value, error) {
+	key := req.Key
+	entry, err := rpcEntry(key)
+	if status.Code(err) == codes.NotFound {
+		logger.Infof("Generating new entry for key: %s", key)
+
+		//Didn't exist, make a new one! Someone else may have beaten us to it.
+		entry = &Entry{Key: key}
+		if err = data.AddEntry(entry); err != nil {
+			logger.Debug(err)
+			entry, err = rpcEntry(key)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid call, entry is not a string value: %s", key)
+		return nil, status.Errorf(codes.FailedPrecondition, "Entry is not a string value.")
+	}
+
+	newid := newLockId()
+
+	//Check the LockId, if unlocked, set lock. If locked, acquire lock.
+	if !entry.SetLockId(newid) {
+		if err := AcquireLock(entry, rpcTimeout(ctx), newid); err != nil {
+			logger.Info(err)
+			return nil, status.Errorf(codes.DeadlineExceeded, "%s", err)
+		}
+	}
+
+	entry.SetValue(req.Value)
+	return &httpdbpb.Value{Key: key, LockId: newid, Revision: entry.GetRevision()}, nil
+}
+
+func (s *rpcServer) Update(ctx context.Context, req *httpdbpb.UpdateRequest) (*httpdbpb.Value, error) {
+	key := req.Key
+	entry, err := rpcEntry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid call, entry is not a string value: %s", key)
+		return nil, status.Errorf(codes.FailedPrecondition, "Entry is not a string value.")
+	}
+
+	if !entry.ValidLock(req.LockId) {
+		logger.Debugf("LockId does not match entry: %s - LockId: %s", key, req.LockId)
+		return nil, status.Errorf(codes.PermissionDenied, "Lock id does not match.")
+	}
+
+	entry.SetValue(req.Value)
+
+	if req.Release {
+		logger.Infof("Removing lock from entry: %s", key)
+		entry.UnsetLockId()
+	}
+	return &httpdbpb.Value{Key: key, Value: entry.GetValue(), Revision: entry.GetRevision()}, nil
+}
+
+func (s *rpcServer) Release(ctx context.Context, req *httpdbpb.LockRequest) (*httpdbpb.Value, error) {
+	key := req.Key
+	entry, err := rpcEntry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if req.LockId == "" || !entry.ValidLock(req.LockId) {
+		logger.Debugf("LockId does not match entry: %s - LockId: %s", key, req.LockId)
+		return nil, status.Errorf(codes.PermissionDenied, "Lock id does not match.")
+	}
+
+	logger.Infof("Removing lock from entry: %s", key)
+	entry.UnsetLockId()
+	return &httpdbpb.Value{Key: key, Revision: entry.GetRevision()}, nil
+}
+
+func (s *rpcServer) Get(ctx context.Context, req *httpdbpb.GetRequest) (*httpdbpb.Value, error) {
+	key := req.Key
+	entry, err := rpcEntry(key)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid call, entry is not a string value: %s", key)
+		return nil, status.Errorf(codes.FailedPrecondition, "Entry is not a string value.")
+	}
+
+	//Revisions start at one, so an unset one means the current value.
+	revision := req.Revision
+	if revision <= 0 {
+		revision = entry.GetRevision()
+	}
+
+	value, exists := entry.GetValueAt(revision)
+	if !exists {
+		logger.Infof("Invalid call, revision not found: %s - %d", key, revision)
+		return nil, status.Errorf(codes.NotFound, "Revision not found.")
+	}
+	return &httpdbpb.Value{Key: key, Value: value, Revision: revision}, nil
+}
+
+func (s *rpcServer) Delete(ctx context.Context, req *httpdbpb.LockRequest) (*httpdbpb.Value, error) {
+	key := req.Key
+	if _, err := rpcEntry(key); err != nil {
+		return nil, err
+	}
+
+	//A transaction checks the lock and deletes in one go.
+	_, results, err := data.Commit(&Txn{Then: []*TxnOp{{Op: TxnDelete, Key: key, LockId: req.LockId}}})
+	if err != nil {
+		logger.Debugf("LockId does not match entry: %s - LockId: %s", key, req.LockId)
+		return nil, status.Errorf(codes.PermissionDenied, "Lock id does not match.")
+	}
+	if results[0].Status == http.StatusNotFound {
+		return nil, status.Errorf(codes.NotFound, "Entry not found.")
+	}
+	return &httpdbpb.Value{Key: key}, nil
+}
+
+// rpcChange converts a change to a Change message.
+func rpcChange(rec *WALRecord) *httpdbpb.Change {
+	c := &httpdbpb.Change{Rev: rec.Rev, Event: rec.Event, Key: rec.Key}
+	if s := rec.Entry; s != nil {
+		c.Type = string(s.Type)
+		if c.Type == "" {
+			c.Type = string(StringEntry)
+		}
+		c.Value = s.Value
+		c.Revision = s.Revision
+	}
+	return c
+}
+
+// Watch streams changes to keys under the prefix until the client goes
+// away, in the same way as GET /watch.
+func (s *rpcServer) Watch(req *httpdbpb.WatchRequest, stream httpdbpb.HttpDB_WatchServer) error {
+	if changes == nil {
+		logger.Info("Invalid call, no change log is kept.")
+		return status.Errorf(codes.FailedPrecondition, "No change log is kept.")
+	}
+
+	prefix := req.Prefix
+	seq := changes.Seq()
+	if req.Since > 0 {
+		seq = req.Since
+	}
+
+	//The headers tell the client the watch is in place.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	logger.Infof("Streaming changes to keys with prefix: %s", prefix)
+
+	for {
+		pending, wake, ok := changes.Since(seq)
+
+		//Changes were missed, so the client has to fetch everything again.
+		if !ok {
+			seq = changes.Seq()
+			logger.Infof("Watcher for prefix %s missed changes, sending a reset at revision %d.", prefix, seq)
+			if err := stream.Send(rpcChange(&WALRecord{Rev: seq, Event: "reset"})); err != nil {
+				return err
+			}
+			pending, wake, _ = changes.Since(seq)
+		}
+
+		for _, change := range pending {
+			seq = change.Rev
+			if !strings.HasPrefix(change.Key, prefix) {
+				continue
+			}
+			if err := stream.Send(rpcChange(change)); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-wake:
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-done:
+			return status.Errorf(codes.Unavailable, "Server is shutting down.")
+		}
+	}
+}
+
+func startRPCServer(stop chan struct{}) {
+	logger.Info("Started gRPC Server Gouroutine.")
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", Config.App.GRPCPort))
+	if err != nil {
+		logger.Error("Listen: ", err)
+		logger.Info("Stopped gRPC Server Goroutine.")
+		return
+	}
+
+	srv := newRPCServer()
+	go func() {
+		<-stop
+		srv.Stop()
+	}()
+
+	logger.Infof("Listening for gRPC connections on port %v!", Config.App.GRPCPort)
+	if err := srv.Serve(listener); err != nil && err != grpc.ErrServerStopped {
+		logger.Error("Serve: ", err)
+	}
+
+	logger.Info("Stopped gRPC Server Goroutine.")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btnmasher/httpdb/httpdbpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+)
+
+// newRPCTestClient serves the gRPC API on loopback and connects a
+// generated client to it.
+func newRPCTestClient(t *testing.T) (httpdbpb.HttpDBClient, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newRPCServer()
+	go srv.Serve(listener)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httpdbpb.NewHttpDBClient(conn), func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestRPC(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	changes = NewChangeLog(100)
+	defer func() { changes = nil }()
+
+	c, stop := newRPCTestClient(t)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	//Watch from the start, before anything changes.
+	stream, err := c.Watch(ctx, &httpdbpb.WatchRequest{Prefix: "rpc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := c.Put(ctx, &httpdbpb.PutRequest{Key: "rpc-a", Value: "first"})
+	if err != nil || reply.LockId == "" || reply.Revision != 1 {
+		t.Fatalf("Should create and reserve the entry. Received: %v %v", err, reply)
+	}
+	lockId := reply.LockId
+
+	//The client's deadline cuts the wait for the lock short.
+	short, cancelShort := context.WithTimeout(ctx, time.Millisecond*200)
+	start := time.Now()
+	_, err = c.Reserve(short, &httpdbpb.KeyRequest{Key: "rpc-a"})
+	cancelShort()
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("Should time out reserving a reserved entry. Received: %s", code)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("Should give up waiting by the client's deadline.")
+	}
+
+	_, err = c.Update(ctx, &httpdbpb.UpdateRequest{Key: "rpc-a", Value: "second", LockId: "wrong"})
+	if code := status.Code(err); code != codes.PermissionDenied {
+		t.Errorf("Should refuse an update with the wrong lock id. Received: %s", code)
+	}
+
+	reply, err = c.Update(ctx, &httpdbpb.UpdateRequest{Key: "rpc-a", Value: "second", LockId: lockId, Release: true})
+	if err != nil || reply.Revision != 2 {
+		t.Errorf("Should update and release the entry. Received: %v %v", err, reply)
+	}
+
+	reply, err = c.Reserve(ctx, &httpdbpb.KeyRequest{Key: "rpc-a"}, grpc.UseCompressor(gzip.Name))
+	if err != nil || reply.Value != "second" || reply.LockId == "" {
+		t.Fatalf("Should reserve the released entry, compressed. Received: %v %v", err, reply)
+	}
+
+	if _, err := c.Release(ctx, &httpdbpb.LockRequest{Key: "rpc-a", LockId: reply.LockId}); err != nil {
+		t.Errorf("Should release the entry. Received: %v", err)
+	}
+
+	if reply, err := c.Get(ctx, &httpdbpb.GetRequest{Key: "rpc-a", Revision: 1}); err != nil || reply.Value != "first" {
+		t.Errorf("Should get an older revision. Received: %v %v", err, reply)
+	}
+	if reply, err := c.Get(ctx, &httpdbpb.GetRequest{Key: "rpc-a"}); err != nil || reply.Value != "second" || reply.Revision != 2 {
+		t.Errorf("Should get the current value. Received: %v %v", err, reply)
+	}
+
+	if _, err := c.Delete(ctx, &httpdbpb.LockRequest{Key: "rpc-a"}); err != nil {
+		t.Errorf("Should delete the entry. Received: %v", err)
+	}
+	if _, err := c.Get(ctx, &httpdbpb.GetRequest{Key: "rpc-a"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Should not find a deleted entry. Received: %v", err)
+	}
+	if _, err := c.Get(ctx, &httpdbpb.GetRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Should refuse a call with no key. Received: %v", err)
+	}
+
+	//Creating, reserving and setting for Put, then Update and its release,
+	//then Reserve, Release and Delete.
+	events := []string{EventPut, EventLock, EventPut, EventPut, EventUnlock, EventLock, EventUnlock, EventDelete}
+	for i, event := range events {
+		change, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Stream ended early after %d changes: %s", i, err)
+		}
+		if change.Event != event || change.Key != "rpc-a" {
+			t.Errorf("Change %d should be %s. Received: %s", i, event, change.Event)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/btnmasher/random"
@@ -88,6 +89,12 @@ func updateVal(w http.ResponseWriter, r *http.Request) {
 	entry.Lock()
 	defer entry.Unlock()
 
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid request, entry is not a string value: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
 	//Check to make sure we got a LockId specified.
 	lockid, exists := vars["lock_id"]
 	if !exists {
@@ -120,15 +127,37 @@ func updateVal(w http.ResponseWriter, r *http.Request) {
 	//or the correct LockId was specified.
 	logger.Debug("LockId matches, reading new value.")
 
-	//Get the new value.
-	bytes, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		logger.Errorf("Error reading request body: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	var value string
+
+	//A rollback query restores a previous revision instead of reading the body.
+	if rb := r.FormValue("rollback"); rb != "" {
+		revision, err := strconv.ParseInt(rb, 10, 64)
+		if err != nil {
+			logger.Infof("Invalid rollback query specified: %s", rb)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		old, exists := entry.GetValueAt(revision)
+		if !exists {
+			logger.Infof("Invalid request, revision not found: %s - %d", key, revision)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		logger.Debugf("Rolling back entry: %s to revision: %d", key, revision)
+		value = old
+	} else {
+		//Get the new value.
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger.Errorf("Error reading request body: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		value = string(bytes)
 	}
 
-	entry.SetValue(string(bytes))
+	entry.SetValue(value)
 	logger.Info("Successfully set new submitted value.")
 	w.WriteHeader(http.StatusNoContent)
 
@@ -169,6 +198,12 @@ func putVal(w http.ResponseWriter, r *http.Request) {
 	entry.Lock()
 	defer entry.Unlock()
 
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid request, entry is not a string value: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
 	logger.Debug("Reading request body... ")
 	//Get the new value.
 	bytes, err := ioutil.ReadAll(r.Body)
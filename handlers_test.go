@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -12,12 +16,22 @@ import (
 	"github.com/btnmasher/lumberjack"
 	"github.com/btnmasher/random"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 var (
 	postResUrl     string
 	postValUrl     string
 	putValUrl      string
+	hashUrl        string
+	hashFieldUrl   string
+	setUrl         string
+	setMemberUrl   string
+	zsetUrl        string
+	zsetMemberUrl  string
+	queueUrl       string
+	backupUrl      string
+	restoreUrl     string
 	recvCodeErrMsg string
 	muxr           *mux.Router
 )
@@ -26,6 +40,15 @@ func init() {
 	postResUrl = "/reservations/%s"
 	putValUrl = "/values/%s"
 	postValUrl = "/values/%s/%s?release=%s"
+	hashUrl = "/hashes/%s"
+	hashFieldUrl = "/hashes/%s/%s"
+	setUrl = "/sets/%s"
+	setMemberUrl = "/sets/%s/members/%s"
+	zsetUrl = "/zsets/%s"
+	zsetMemberUrl = "/zsets/%s/members/%s"
+	queueUrl = "/queues/%s"
+	backupUrl = "/admin/backup?locks=%s"
+	restoreUrl = "/admin/restore?mode=%s"
 	recvCodeErrMsg = "Should have received %v. Received: %v"
 	muxr = mux.NewRouter()
 	regHandlers(muxr)
@@ -38,6 +61,8 @@ func init() {
 	go startLockMinder(done)
 
 	Config.App.TimeOut = 1
+	Config.App.VisibilityTimeOut = 30
+	Config.App.HistoryLength = 3
 }
 
 func TestReserveKeyNoExists(t *testing.T) {
@@ -529,6 +554,1463 @@ func TestReserveKeyExistsLockedAcquire(t *testing.T) {
 	}
 }
 
+func TestHashSetGetDeleteField(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+	testVal := random.String(10)
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf(hashFieldUrl, testKey, "name"), strings.NewReader(testVal))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(hashFieldUrl, testKey, "name"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != testVal {
+		t.Error("Received field value should match expected value.")
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(hashUrl, testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	fields := make(map[string]string)
+	err = json.Unmarshal(w.Body.Bytes(), &fields)
+	if err != nil {
+		t.Errorf("Unmarshal error: %s", err)
+	}
+
+	if fields["name"] != testVal {
+		t.Error("Received fields should contain expected value.")
+	}
+
+	req, err = http.NewRequest("DELETE", fmt.Sprintf(hashFieldUrl, testKey, "name"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(hashFieldUrl, testKey, "name"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNotFound, w.Code)
+}
+
+func TestHashSetFieldLocked(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+	testLockId := random.String(5)
+
+	err := data.AddEntry(&Entry{Key: testKey, Type: HashEntry, LockId: testLockId})
+	if err != nil {
+		t.Error(err)
+	}
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf(hashFieldUrl, testKey, "name"), strings.NewReader("value"))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusUnauthorized, w.Code)
+
+	req, err = http.NewRequest("PUT", fmt.Sprintf(hashFieldUrl+"?lock_id=%s", testKey, "name", testLockId), strings.NewReader("value"))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+}
+
+func TestHashWrongType(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+
+	err := data.AddEntry(&Entry{Key: testKey, Value: random.String(10)})
+	if err != nil {
+		t.Error(err)
+	}
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf(hashFieldUrl, testKey, "name"), strings.NewReader("value"))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusConflict, w.Code)
+}
+
+func TestSetMembership(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+
+	for _, m := range []string{"carol", "alice", "bob", "alice"} {
+		req, err := http.NewRequest("PUT", fmt.Sprintf(setMemberUrl, testKey, m), nil)
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusNoContent, w.Code)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(setUrl, testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `["alice","bob","carol"]` {
+		t.Errorf("Received unexpected members: %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("DELETE", fmt.Sprintf(setMemberUrl, testKey, "bob"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(setMemberUrl, testKey, "bob"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNotFound, w.Code)
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(setUrl+"/count", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"count":2}` {
+		t.Errorf("Received unexpected count: %s", w.Body.String())
+	}
+}
+
+func TestSetUnionIntersect(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	data.AddEntry(&Entry{Key: "a", Type: SetEntry, Members: []string{"1", "2", "3"}})
+	data.AddEntry(&Entry{Key: "b", Type: SetEntry, Members: []string{"2", "3", "4"}})
+
+	req, err := http.NewRequest("GET", "/sets?op=union&key=a&key=b", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `["1","2","3","4"]` {
+		t.Errorf("Received unexpected union: %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("GET", "/sets?op=intersect&key=a&key=b", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `["2","3"]` {
+		t.Errorf("Received unexpected intersection: %s", w.Body.String())
+	}
+}
+
+func TestSetAddMemberLocked(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+	testLockId := random.String(5)
+
+	data.AddEntry(&Entry{Key: testKey, Type: SetEntry, LockId: testLockId})
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf(setMemberUrl, testKey, "alice"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestZSetRanges(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+
+	for m, s := range map[string]string{"a": "3", "b": "1", "c": "2", "d": "2"} {
+		req, err := http.NewRequest("PUT", fmt.Sprintf(zsetMemberUrl, testKey, m), strings.NewReader(s))
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusNoContent, w.Code)
+	}
+
+	tests := map[string]string{
+		"":                          `[{"member":"b","score":1},{"member":"c","score":2},{"member":"d","score":2},{"member":"a","score":3}]`,
+		"?start=1&stop=2":           `[{"member":"c","score":2},{"member":"d","score":2}]`,
+		"?start=-1":                 `[{"member":"a","score":3}]`,
+		"?max=2":                    `[{"member":"b","score":1},{"member":"c","score":2},{"member":"d","score":2}]`,
+		"?min=2&max=%2Binf&limit=2": `[{"member":"c","score":2},{"member":"d","score":2}]`,
+	}
+
+	for query, expected := range tests {
+		req, err := http.NewRequest("GET", fmt.Sprintf(zsetUrl, testKey)+query, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusOK, w.Code)
+
+		if w.Body.String() != expected {
+			t.Errorf("Query %q received unexpected range: %s", query, w.Body.String())
+		}
+	}
+}
+
+func TestZSetRank(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+
+	data.AddEntry(&Entry{Key: testKey, Type: ZSetEntry})
+	entry, _ := data.GetEntry(testKey)
+	entry.SetScore("a", 10)
+	entry.SetScore("b", 5)
+	entry.SetScore("a", 1)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(zsetMemberUrl, testKey, "b"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"member":"b","score":5,"rank":1}` {
+		t.Errorf("Received unexpected member: %s", w.Body.String())
+	}
+
+	for _, body := range []string{"notanumber", "NaN", "inf", "-Inf"} {
+		req, err = http.NewRequest("PUT", fmt.Sprintf(zsetMemberUrl, testKey, "c"), strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		w = httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestQueueReceiveAck(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testName := random.String(5)
+
+	for _, body := range []string{"first", "second"} {
+		req, err := http.NewRequest("POST", fmt.Sprintf(queueUrl, testName), strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusCreated, w.Code)
+	}
+
+	received := make([]QueueMessage, 0, 2)
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("POST", fmt.Sprintf(queueUrl+"/receive", testName), nil)
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+
+		if i == 2 {
+			checkCode(t, http.StatusNoContent, w.Code)
+			break
+		}
+		checkCode(t, http.StatusOK, w.Code)
+
+		var m QueueMessage
+		err = json.Unmarshal(w.Body.Bytes(), &m)
+		if err != nil {
+			t.Errorf("Unmarshal error: %s", err)
+		}
+		received = append(received, m)
+	}
+
+	if received[0].Body != "first" || received[1].Body != "second" {
+		t.Error("Messages should be received in FIFO order.")
+	}
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf(queueUrl+"/receipts/%s", testName, received[0].Receipt), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(queueUrl+"/receipts/%s/nack", testName, received[1].Receipt), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(queueUrl+"/receive", testName), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	var m QueueMessage
+	json.Unmarshal(w.Body.Bytes(), &m)
+	if m.Body != "second" || m.Receives != 2 {
+		t.Error("Nacked message should be redelivered.")
+	}
+}
+
+func TestQueueLeaseExpiry(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testName := random.String(5)
+
+	data.AddEntry(&Entry{Key: testName, Type: QueueEntry})
+	entry, _ := data.GetEntry(testName)
+	entry.Enqueue("job")
+
+	first := entry.Receive(time.Minute)
+	if entry.Receive(time.Minute) != nil {
+		t.Error("Leased message should not be visible.")
+	}
+
+	//Pretend the lease ran out.
+	entry.Messages[0].VisibleAt = time.Now().Add(-time.Second)
+
+	if entry.Ack(first.Receipt) {
+		t.Error("Expired receipt should not ack.")
+	}
+
+	second := entry.Receive(time.Minute)
+	if second == nil || second.Id != first.Id {
+		t.Error("Expired message should be redelivered.")
+	}
+
+	if !entry.Ack(second.Receipt) || len(entry.Messages) != 0 {
+		t.Error("Current receipt should ack the message.")
+	}
+}
+
+func TestValueHistoryAndRollback(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+	testLockId := random.String(5)
+
+	data.AddEntry(&Entry{Key: testKey, LockId: testLockId})
+	entry, _ := data.GetEntry(testKey)
+	for _, v := range []string{"one", "two", "three", "four"} {
+		entry.SetValue(v)
+	}
+
+	if len(entry.GetHistory()) != 3 {
+		t.Errorf("History should be trimmed to 3 revisions, has: %d", len(entry.GetHistory()))
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(putValUrl+"?revision=2", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"revision":2,"value":"two"}` {
+		t.Errorf("Received unexpected revision: %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(putValUrl+"?revision=1", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNotFound, w.Code)
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(postValUrl+"&rollback=2", testKey, testLockId, "false"), strings.NewReader("ignored"))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	if entry.GetValue() != "two" || entry.GetRevision() != 5 {
+		t.Error("Rollback should write the old value as a new revision.")
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(putValUrl+"/history", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	var history []Revision
+	err = json.Unmarshal(w.Body.Bytes(), &history)
+	if err != nil {
+		t.Errorf("Unmarshal error: %s", err)
+	}
+
+	if len(history) != 3 || history[0].Revision != 3 || history[2].Value != "two" {
+		t.Errorf("Received unexpected history: %v", history)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	kept, _ := data.NewEntry("kept")
+	kept.SetValue("one")
+	kept.SetValue("two")
+	kept.SetLockId("lock")
+	data.AddEntry(&Entry{Key: "hash", Type: HashEntry, Fields: map[string]string{"name": "value"}})
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(backupUrl, ""), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+	backup := w.Body.Bytes()
+
+	kept.SetValue("three")
+	data.NewEntry("extra")
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(restoreUrl, "merge"), strings.NewReader(string(backup)))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	restored, err := data.GetEntry("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.GetValue() != "two" || restored.GetRevision() != 2 || len(restored.GetHistory()) != 2 {
+		t.Error("Restored entry should have its backed up value and history.")
+	}
+
+	if restored.IsLocked() {
+		t.Error("Locks should be left out of the backup by default.")
+	}
+
+	if h, err := data.GetEntry("hash"); err != nil || !h.IsType(HashEntry) {
+		t.Error("Restored hash should keep its type.")
+	}
+
+	if !data.EntryExists("extra") {
+		t.Error("Merge should leave keys missing from the backup alone.")
+	}
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(restoreUrl, "replace"), strings.NewReader(string(backup)))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"removed":1,"restored":2}` {
+		t.Errorf("Received unexpected restore counts: %s", w.Body.String())
+	}
+
+	if data.EntryExists("extra") {
+		t.Error("Replace should delete keys missing from the backup.")
+	}
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(restoreUrl, "merge"), strings.NewReader(string(backup[:len(backup)-5])))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(restoreUrl, "bogus"), strings.NewReader(string(backup)))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+
+	//Restoring an entry with the lock it already has leaves the lock be.
+	restored, _ = data.GetEntry("kept")
+	restored.SetLockId("held")
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(backupUrl, "true"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+	backup = w.Body.Bytes()
+
+	restored.SetValue("four")
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(restoreUrl, "merge"), strings.NewReader(string(backup)))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if data.Entries["kept"] != restored || !restored.ValidLock("held") || restored.GetValue() != "two" {
+		t.Error("Entry keeping its lock should be restored in place.")
+	}
+}
+
+func TestBulkImportExport(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	existing, _ := data.NewEntry("b")
+	existing.SetValue("old")
+	locked, _ := data.NewEntry("c")
+	locked.SetLockId("lock")
+	data.AddEntry(&Entry{Key: "set", Type: SetEntry})
+
+	lines := `{"key":"a","value":"one","ttl":60}` + "\n\n" +
+		`{"key":"b","value":"two","content_type":"text/plain"}` + "\n" +
+		`{"key":"c","value":"three"}` + "\n" +
+		`{"key":"set","value":"four"}` + "\n"
+
+	req, err := http.NewRequest("POST", "/bulk/import", strings.NewReader(lines))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"imported":2,"skipped":["c","set"]}` {
+		t.Errorf("Received unexpected import results: %s", w.Body.String())
+	}
+
+	if existing.GetValue() != "two" || existing.GetRevision() != 2 {
+		t.Error("Import should write a new revision of existing values.")
+	}
+
+	if locked.GetValue() != "" {
+		t.Error("Import should not overwrite locked values.")
+	}
+
+	req, err = http.NewRequest("POST", "/bulk/import", strings.NewReader(`{"key":"d","value":"five"}`+"\n{bad"))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+
+	if data.EntryExists("d") {
+		t.Error("A bad import should not apply any lines.")
+	}
+
+	req, err = http.NewRequest("POST", "/bulk/import", strings.NewReader(`{"key":"d","value":"five","ttl":-1}`))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(putValUrl, "b"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"content_type":"text/plain","revision":2,"value":"two"}` {
+		t.Errorf("Value should come with its content type. Received: %s", w.Body.String())
+	}
+
+	//The export command goes through a real server.
+	server := httptest.NewServer(muxr)
+	defer server.Close()
+	serverUrl = server.URL
+	defer func() { serverUrl = "" }()
+
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.jsonl")
+
+	if err := runCommand([]string{"export", path}); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, _ := ioutil.ReadFile(path)
+	expected := `{"key":"a","value":"one","ttl":60}` + "\n" + `{"key":"b","value":"two","content_type":"text/plain"}` + "\n" + `{"key":"c","value":""}` + "\n"
+	if string(contents) != expected {
+		t.Errorf("Received unexpected export: %s", contents)
+	}
+
+	if count := data.ExpireEntries(time.Now().Add(time.Minute)); count != 1 || data.EntryExists("a") {
+		t.Errorf("Entry should be deleted once its ttl runs out. Deleted: %d", count)
+	}
+}
+
+func TestChangeFeed(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	changes = NewChangeLog(100)
+	defer func() { changes = nil }()
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf(putValUrl, "a"), strings.NewReader("one"))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	var reply map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Errorf("Unmarshal error: %s", err)
+	}
+
+	req, err = http.NewRequest("POST", fmt.Sprintf(postValUrl, "a", reply["lock_id"], "true"), strings.NewReader("two"))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	data.DeleteEntry("a")
+
+	type feed struct {
+		Rev     int64        `json:"rev"`
+		More    bool         `json:"more"`
+		Changes []*WALRecord `json:"changes"`
+	}
+
+	req, err = http.NewRequest("GET", "/changes?since=0", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	var all feed
+	if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil {
+		t.Errorf("Unmarshal error: %s", err)
+	}
+
+	events := []string{}
+	for i, c := range all.Changes {
+		if c.Rev != int64(i+1) {
+			t.Errorf("Revisions should count up from one. Received: %d at %d", c.Rev, i)
+		}
+		if c.Entry != nil && c.Entry.LockId != "" {
+			t.Error("Lock ids should not be in the change feed.")
+		}
+		events = append(events, c.Event)
+	}
+
+	seen := strings.Join(events, ",")
+	if !strings.Contains(seen, "lock") || !strings.Contains(seen, "unlock") || !strings.HasSuffix(seen, "delete") {
+		t.Errorf("Every kind of change should be in the feed. Received: %s", seen)
+	}
+	if all.Rev != changes.Seq() || all.More {
+		t.Errorf("The whole feed should be returned up to the latest revision. Received: %d", all.Rev)
+	}
+
+	req, err = http.NewRequest("GET", "/changes?since=1&limit=2", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	var page feed
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Errorf("Unmarshal error: %s", err)
+	}
+	if len(page.Changes) != 2 || page.Changes[0].Rev != 2 || page.Rev != 3 || !page.More {
+		t.Errorf("Should get a page of changes after the revision. Received: %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf("/changes?since=%d", all.Rev+1), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusGone, w.Code)
+
+	req, err = http.NewRequest("GET", "/changes?since=x", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWatchVal(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	testKey := random.String(5)
+
+	entry, _ := data.NewEntry(testKey)
+	entry.SetValue("one")
+
+	//An older revision is answered straight away.
+	req, err := http.NewRequest("GET", fmt.Sprintf(putValUrl+"?watch=true&revision=0", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"revision":1,"value":"one"}` {
+		t.Errorf("Received unexpected value: %s", w.Body.String())
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		entry.Lock()
+		entry.SetLockId("lock")
+		entry.Unlock()
+		time.Sleep(time.Millisecond * 100)
+		entry.Lock()
+		entry.SetValue("two")
+		entry.Unlock()
+	}()
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(putValUrl+"?watch=true&revision=1", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Body.String() != `{"revision":2,"value":"two"}` {
+		t.Errorf("Should wait for the next revision. Received: %s", w.Body.String())
+	}
+
+	start := time.Now()
+	req, err = http.NewRequest("GET", fmt.Sprintf(putValUrl+"?watch=true", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if time.Since(start) < time.Second*Config.App.TimeOut {
+		t.Error("Should wait out the timeout with no new revision.")
+	}
+	if w.Body.String() != `{"revision":2,"value":"two"}` {
+		t.Errorf("Should send the current value once the watch times out. Received: %s", w.Body.String())
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		data.DeleteEntry(testKey)
+	}()
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(putValUrl+"?watch=true", testKey), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNotFound, w.Code)
+
+	if len(watchers.keys) != 0 {
+		t.Error("Watches should be cleaned up once done.")
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	changes = NewChangeLog(5)
+	defer func() { changes = nil }()
+
+	server := httptest.NewServer(muxr)
+	defer server.Close()
+
+	//readEvents reads count events as "id event key" from a watch.
+	readEvents := func(lastId string, count int, during func()) []string {
+		req, err := http.NewRequest("GET", server.URL+"/watch?prefix=conf/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastId != "" {
+			req.Header.Set("Last-Event-ID", lastId)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Errorf("Should stream events. Received: %s", resp.Header.Get("Content-Type"))
+		}
+
+		finished := make(chan struct{})
+		go func() {
+			during()
+			close(finished)
+		}()
+		defer func() { <-finished }()
+
+		events := []string{}
+		var id, event string
+		scanner := bufio.NewScanner(resp.Body)
+		for len(events) < count && scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				var rec WALRecord
+				json.Unmarshal([]byte(line[6:]), &rec)
+				if rec.Entry != nil && rec.Entry.LockId != "" {
+					t.Error("Lock ids should not be in the event stream.")
+				}
+				events = append(events, fmt.Sprintf("%s %s %s", id, event, rec.Key))
+			}
+		}
+		return events
+	}
+
+	events := readEvents("", 4, func() {
+		entry, _ := data.NewEntry("conf/a")
+		data.NewEntry("other")
+		entry.Lock()
+		entry.SetLockId("lock")
+		entry.SetValue("one")
+		entry.Unlock()
+		data.DeleteEntry("conf/a")
+	})
+
+	expected := "1 put conf/a,3 lock conf/a,4 put conf/a,5 delete conf/a"
+	if strings.Join(events, ",") != expected {
+		t.Errorf("Should only stream changes under the prefix. Received: %v", events)
+	}
+
+	events = readEvents("3", 2, func() {})
+	if strings.Join(events, ",") != "4 put conf/a,5 delete conf/a" {
+		t.Errorf("Should resume after the last event id. Received: %v", events)
+	}
+
+	for i := 0; i < 5; i++ {
+		data.NewEntry(fmt.Sprintf("other-%d", i))
+	}
+
+	events = readEvents("1", 2, func() {
+		data.NewEntry("conf/b")
+	})
+	if strings.Join(events, ",") != "10 reset ,11 put conf/b" {
+		t.Errorf("Should reset when changes since the last event id are gone. Received: %v", events)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	changes = NewChangeLog(100)
+	defer func() { changes = nil }()
+
+	data.NewEntry("a")
+
+	server := httptest.NewServer(muxr)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/sessions"
+	send := func(ws *websocket.Conn, req *SessionRequest) {
+		j, _ := json.Marshal(req)
+		if err := ws.WriteMessage(websocket.TextMessage, j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(ws *websocket.Conn) *SessionReply {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := &SessionReply{}
+		if err := json.Unmarshal(message, reply); err != nil {
+			t.Errorf("Unmarshal error: %s", err)
+		}
+		return reply
+	}
+
+	first, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send(first, &SessionRequest{Id: "1", Op: SessionReserve, Key: "a"})
+	reserved := receive(first)
+	if reserved.Id != "1" || reserved.Status != http.StatusOK || reserved.LockId == "" {
+		t.Fatalf("Should reserve the entry. Received: %v", reserved)
+	}
+
+	send(first, &SessionRequest{Id: "2", Op: SessionUpdate, Key: "a", LockId: "wrong", Value: "one"})
+	if reply := receive(first); reply.Status != http.StatusUnauthorized {
+		t.Errorf("Should need the lock to update. Received: %v", reply)
+	}
+
+	send(first, &SessionRequest{Id: "3", Op: SessionUpdate, Key: "a", LockId: reserved.LockId, Value: "one"})
+	if reply := receive(first); reply.Status != http.StatusOK || reply.Revision != 1 {
+		t.Errorf("Should update with the lock. Received: %v", reply)
+	}
+
+	watcher, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	send(watcher, &SessionRequest{Id: "w", Op: SessionWatch, Prefix: "a"})
+	if reply := receive(watcher); reply.Status != http.StatusOK {
+		t.Fatalf("Should start watching. Received: %v", reply)
+	}
+
+	second, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	//Dropping the first socket hands its lock on to the waiting one.
+	send(second, &SessionRequest{Id: "4", Op: SessionReserve, Key: "a"})
+	time.Sleep(time.Millisecond * 100)
+	first.Close()
+
+	handed := receive(second)
+	if handed.Status != http.StatusOK || handed.Value != "one" {
+		t.Fatalf("The lock should be released when the session drops. Received: %v", handed)
+	}
+
+	send(second, &SessionRequest{Id: "5", Op: SessionUpdate, Key: "a", LockId: handed.LockId, Value: "two", Release: true})
+	if reply := receive(second); reply.Status != http.StatusOK || reply.Revision != 2 {
+		t.Errorf("Should update and release. Received: %v", reply)
+	}
+
+	events := []string{}
+	for len(events) < 4 {
+		reply := receive(watcher)
+		if reply.Id != "w" || reply.Change == nil {
+			t.Fatalf("Should only get changes on a watch. Received: %v", reply)
+		}
+		events = append(events, reply.Change.Event)
+	}
+	if strings.Join(events, ",") != "unlock,lock,put,unlock" {
+		t.Errorf("Should watch every change to the entry. Received: %v", events)
+	}
+
+	req, err := http.NewRequest("GET", "/sessions", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusUpgradeRequired, w.Code)
+
+	//Only so many requests run at once.
+	busy, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	for i := 0; i < sessionMaxRequests; i++ {
+		send(busy, &SessionRequest{Op: SessionWatch})
+		receive(busy)
+	}
+	send(busy, &SessionRequest{Id: "6", Op: SessionWatch})
+	if reply := receive(busy); reply.Id != "6" || reply.Status != http.StatusTooManyRequests {
+		t.Errorf("Should refuse requests past the limit. Received: %v", reply)
+	}
+
+	//Browsers can only open one from the same host, or an allowed origin.
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://elsewhere.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Should refuse a session from another origin.")
+	}
+
+	Config.App.SessionOrigins = []string{"http://elsewhere.example"}
+	defer func() { Config.App.SessionOrigins = nil }()
+	allowed, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://elsewhere.example"}})
+	if err != nil {
+		t.Fatalf("Should allow a session from an allowed origin: %s", err)
+	}
+	allowed.Close()
+}
+
+func TestListValues(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	for _, key := range []string{"b", "a2", "a1", "a3"} {
+		entry, _ := data.NewEntry(key)
+		entry.SetValue("value-" + key)
+	}
+	data.AddEntry(&Entry{Key: "a4", Type: HashEntry})
+	locked, _ := data.GetEntry("a2")
+	locked.SetLockId("lock")
+
+	type listing struct {
+		Keys   []*KeyListing `json:"keys"`
+		Cursor string        `json:"cursor"`
+	}
+
+	list := func(query string) *listing {
+		req, err := http.NewRequest("GET", "/values?"+query, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusOK, w.Code)
+
+		l := &listing{}
+		if err := json.Unmarshal(w.Body.Bytes(), l); err != nil {
+			t.Errorf("Unmarshal error: %s", err)
+		}
+		return l
+	}
+
+	first := list("prefix=a&limit=3&values=true&locks=true")
+	if len(first.Keys) != 3 || first.Keys[0].Key != "a1" || first.Keys[2].Key != "a3" || first.Cursor == "" {
+		t.Fatalf("Should list the first page in key order. Received: %v", first)
+	}
+	if *first.Keys[0].Value != "value-a1" || first.Keys[0].Revision != 1 || *first.Keys[0].Locked || !*first.Keys[1].Locked {
+		t.Error("Should include values and lock status when asked.")
+	}
+
+	second := list("prefix=a&limit=3&cursor=" + first.Cursor)
+	if len(second.Keys) != 1 || second.Keys[0].Key != "a4" || second.Keys[0].Type != HashEntry || second.Cursor != "" {
+		t.Errorf("Should list the rest after the cursor. Received: %v", second)
+	}
+	if second.Keys[0].Value != nil || second.Keys[0].Locked != nil {
+		t.Error("Should leave out values and lock status unless asked.")
+	}
+
+	if all := list(""); len(all.Keys) != 5 || all.Keys[4].Key != "b" {
+		t.Errorf("Should list every key without a prefix. Received: %v", all)
+	}
+
+	req, err := http.NewRequest("GET", "/values?cursor=!", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRangeValues(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	for _, key := range []string{"e", "c", "a", "d", "b"} {
+		entry, _ := data.NewEntry(key)
+		entry.SetValue("value-" + key)
+	}
+	locked, _ := data.GetEntry("c")
+	locked.SetLockId("lock")
+
+	keys := func(query string) []string {
+		req, err := http.NewRequest("GET", "/range?"+query, nil)
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusOK, w.Code)
+
+		l := &struct {
+			Keys   []*KeyListing `json:"keys"`
+			Cursor string        `json:"cursor"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), l); err != nil {
+			t.Errorf("Unmarshal error: %s", err)
+		}
+
+		found := []string{}
+		for _, k := range l.Keys {
+			found = append(found, k.Key)
+		}
+		if l.Cursor != "" {
+			found = append(found, "cursor="+l.Cursor)
+		}
+		return found
+	}
+
+	tests := map[string]string{
+		"start=b&end=d": "[b c]",
+		"start=b&end=d&start_exclusive=true&end_inclusive=true": "[c d]",
+		"start=b&end=d&reverse=true":                            "[c b]",
+		"end=c&end_inclusive=true&reverse=true":                 "[c b a]",
+		"start=d":                                               "[d e]",
+		"":                                                      "[a b c d e]",
+	}
+	for query, expected := range tests {
+		if found := fmt.Sprint(keys(query)); found != expected {
+			t.Errorf("Range %q should list %s. Received: %s", query, expected, found)
+		}
+	}
+
+	//Pages carry on from the cursor in either direction.
+	page := keys("start=a&limit=2&reverse=true")
+	if len(page) != 3 || page[0] != "e" || page[1] != "d" {
+		t.Fatalf("Should list the first page in reverse. Received: %v", page)
+	}
+	if rest := fmt.Sprint(keys("start=a&reverse=true&" + page[2])); rest != "[c b a]" {
+		t.Errorf("Should list the rest after the cursor. Received: %s", rest)
+	}
+
+	req, err := http.NewRequest("GET", "/range?start=b&count=true", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+	if w.Body.String() != `{"count":4}` {
+		t.Errorf("Should count the keys in the range. Received: %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("DELETE", "/range", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+
+	req, err = http.NewRequest("DELETE", "/range?start=b&end=e", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+	if w.Body.String() != `{"deleted":2,"skipped":["c"]}` {
+		t.Errorf("Should delete the range apart from locked keys. Received: %s", w.Body.String())
+	}
+
+	if found := fmt.Sprint(keys("")); found != "[a c e]" {
+		t.Errorf("Should have only the keys outside the range or locked left. Received: %s", found)
+	}
+	if data.EntryExists("b") || !data.EntryExists("c") {
+		t.Error("Should delete the entries themselves.")
+	}
+}
+
+func TestBatchValues(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	for _, key := range []string{"a", "b"} {
+		entry, _ := data.NewEntry(key)
+		entry.SetValue("value-" + key)
+	}
+	data.AddEntry(&Entry{Key: "h", Type: HashEntry})
+	held, _ := data.GetEntry("b")
+	held.SetLockId("lock")
+
+	batch := func(path, body string) []*BatchResult {
+		req, err := http.NewRequest("POST", path, strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusOK, w.Code)
+
+		res := &struct {
+			Results []*BatchResult `json:"results"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+			t.Errorf("Unmarshal error: %s", err)
+		}
+		return res.Results
+	}
+
+	got := batch("/batch/get", `{"keys": ["a", "missing", "h", "b"]}`)
+	if len(got) != 4 {
+		t.Fatalf("Should return a result for every key. Received: %v", got)
+	}
+	if got[0].Status != http.StatusOK || *got[0].Value != "value-a" || got[0].Revision != 1 {
+		t.Errorf("Should return the value of an existing key. Received: %v", got[0])
+	}
+	if got[1].Status != http.StatusNotFound || got[2].Status != http.StatusConflict || got[3].Status != http.StatusOK {
+		t.Errorf("Should return the status of each key. Received: %d %d %d", got[1].Status, got[2].Status, got[3].Status)
+	}
+
+	put := batch("/batch/put", `{"items": [
+		{"key": "new", "value": "created"},
+		{"key": "b", "value": "updated", "lock_id": "lock", "release": true},
+		{"key": "a", "value": "nope", "lock_id": "wrong"},
+		{"key": "h", "value": "nope"},
+		{"key": "b", "value": "again"}
+	]}`)
+	if len(put) != 5 {
+		t.Fatalf("Should return a result for every item. Received: %v", put)
+	}
+
+	codes := []int{http.StatusOK, http.StatusNoContent, http.StatusUnauthorized, http.StatusConflict, http.StatusOK}
+	for i, code := range codes {
+		if put[i].Status != code {
+			t.Errorf("Item %d should have status %d. Received: %d", i, code, put[i].Status)
+		}
+	}
+	if put[0].LockId == "" || put[4].LockId == "" || put[4].Revision != 3 {
+		t.Errorf("Should reserve entries put without a lock id. Received: %v %v", put[0], put[4])
+	}
+
+	entry, err := data.GetEntry("new")
+	if err != nil || entry.GetValue() != "created" || !entry.ValidLock(put[0].LockId) {
+		t.Error("Should create and reserve new entries.")
+	}
+	if a, _ := data.GetEntry("a"); a.GetValue() != "value-a" {
+		t.Error("Should leave entries alone when the lock id is wrong.")
+	}
+	if b, _ := data.GetEntry("b"); b.GetValue() != "again" {
+		t.Error("Should apply items in order.")
+	}
+
+	for path, body := range map[string]string{"/batch/get": "{", "/batch/put": `{"items": [null]}`} {
+		req, err := http.NewRequest("POST", path, strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	for _, key := range []string{"a", "b"} {
+		entry, _ := data.NewEntry(key)
+		entry.SetValue("value-" + key)
+	}
+	held, _ := data.GetEntry("b")
+	held.SetLockId("lock")
+
+	txn := func(body string, code int) map[string]interface{} {
+		req, err := http.NewRequest("POST", "/txn", strings.NewReader(body))
+		if err != nil {
+			t.Error(err)
+		}
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		checkCode(t, code, w.Code)
+
+		reply := make(map[string]interface{})
+		if code != http.StatusBadRequest || w.Body.Len() > 0 {
+			if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+				t.Errorf("Unmarshal error: %s", err)
+			}
+		}
+		return reply
+	}
+
+	//Every comparison passes, so the then ops run.
+	reply := txn(`{
+		"compare": [
+			{"key": "a", "value": "value-a", "revision": 1, "unlocked": true},
+			{"key": "c", "exists": false}
+		],
+		"then": [
+			{"op": "put", "key": "a", "value": "then-a"},
+			{"op": "put", "key": "c", "value": "then-c"},
+			{"op": "put", "key": "b", "value": "then-b", "lock_id": "lock", "release": true}
+		],
+		"else": [{"op": "delete", "key": "a"}]
+	}`, http.StatusOK)
+	if reply["succeeded"] != true || len(reply["results"].([]interface{})) != 3 {
+		t.Fatalf("Should run the then ops when every comparison passes. Received: %v", reply)
+	}
+
+	a, _ := data.GetEntry("a")
+	b, _ := data.GetEntry("b")
+	c, err := data.GetEntry("c")
+	if a.GetValue() != "then-a" || b.GetValue() != "then-b" || b.IsLocked() || err != nil || c.GetValue() != "then-c" {
+		t.Error("Should apply every then op.")
+	}
+
+	//One fails, so the else ops run.
+	reply = txn(`{
+		"compare": [{"key": "a", "revision": 1}],
+		"then": [{"op": "put", "key": "a", "value": "nope"}],
+		"else": [{"op": "delete", "key": "c"}, {"op": "delete", "key": "missing"}]
+	}`, http.StatusOK)
+	results := reply["results"].([]interface{})
+	if reply["succeeded"] != false || len(results) != 2 || results[1].(map[string]interface{})["status"] != float64(http.StatusNotFound) {
+		t.Fatalf("Should run the else ops when a comparison fails. Received: %v", reply)
+	}
+	if a.GetValue() != "then-a" || data.EntryExists("c") {
+		t.Error("Should apply only the else ops.")
+	}
+
+	//A locked entry without its lock id stops the whole transaction.
+	b.SetLockId("other")
+	reply = txn(`{
+		"then": [
+			{"op": "put", "key": "a", "value": "nope"},
+			{"op": "put", "key": "b", "value": "nope"}
+		]
+	}`, http.StatusUnauthorized)
+	if reply["key"] != "b" || a.GetValue() != "then-a" || b.GetValue() != "then-b" {
+		t.Errorf("Should apply nothing when an op can't be. Received: %v", reply)
+	}
+
+	data.AddEntry(&Entry{Key: "h", Type: HashEntry})
+	txn(`{"then": [{"op": "put", "key": "h", "value": "nope"}]}`, http.StatusConflict)
+	txn(`{"compare": [{"key": "a"}]}`, http.StatusBadRequest)
+	txn(`{"then": [{"op": "move", "key": "a"}]}`, http.StatusBadRequest)
+	txn(`{"compare": [null]}`, http.StatusBadRequest)
+	txn(`{"then": [null]}`, http.StatusBadRequest)
+	txn(`{"else": [null]}`, http.StatusBadRequest)
+	txn(`{`, http.StatusBadRequest)
+}
+
+func TestIdempotentPut(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	idempotency = &IdempotencyCache{responses: make(map[string]*idempotentResponse)}
+	Config.App.IdempotencyWindow = 60
+	defer func() { Config.App.IdempotencyWindow = 0 }()
+
+	testKey := random.String(5)
+
+	put := func(key, value string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", fmt.Sprintf(putValUrl, testKey), strings.NewReader(value))
+		if err != nil {
+			t.Error(err)
+		}
+		req.Header.Set(idempotencyHeader, key)
+		w := httptest.NewRecorder()
+		muxr.ServeHTTP(w, req)
+		return w
+	}
+
+	first := put("retry", "value")
+	checkCode(t, http.StatusOK, first.Code)
+
+	//Without the key the retry would wait on its own lock.
+	retry := put("retry", "value")
+	checkCode(t, http.StatusOK, retry.Code)
+	if retry.Body.String() != first.Body.String() || retry.Header().Get(replayedHeader) != "true" {
+		t.Errorf("Should replay the first response. Received: %s", retry.Body.String())
+	}
+
+	reply := make(map[string]string)
+	json.Unmarshal(first.Body.Bytes(), &reply)
+	entry, _ := data.GetEntry(testKey)
+	if entry.GetRevision() != 1 || !entry.ValidLock(reply["lock_id"]) {
+		t.Error("Should not run the request again.")
+	}
+
+	checkCode(t, http.StatusUnprocessableEntity, put("retry", "other").Code)
+
+	//Once the window is over the key can be used again.
+	idempotency.responses["retry"].expires = time.Now()
+	if idempotency.Expire() != 1 {
+		t.Error("Should expire responses kept past the window.")
+	}
+	checkCode(t, http.StatusRequestTimeout, put("retry", "value").Code)
+
+	//A handler that panics frees the key for a retry.
+	panicking := idempotentRoute(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	}))
+	func() {
+		defer func() { recover() }()
+		req, _ := http.NewRequest("POST", "/panic", nil)
+		req.Header.Set(idempotencyHeader, "panic")
+		panicking.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if _, first := idempotency.Begin("panic", "POST /panic"); !first {
+		t.Error("Should free the key when the handler panics.")
+	}
+}
+
 func checkCode(t *testing.T, expected, received int) {
 	if received != expected {
 		t.Errorf(recvCodeErrMsg, expected, received)
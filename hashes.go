@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/mux"
+)
+
+func (e *Entry) GetField(field string) (string, bool) {
+	// e.Lock()
+	// defer e.Unlock()
+	value, exists := e.Fields[field]
+	return value, exists
+}
+
+func (e *Entry) SetField(field, value string) {
+	// e.Lock()
+	// defer e.Unlock()
+	if e.Fields == nil {
+		e.Fields = make(map[string]string)
+	}
+	e.Fields[field] = value
+	e.commit()
+}
+
+func (e *Entry) DeleteField(field string) bool {
+	// e.Lock()
+	// defer e.Unlock()
+	if _, exists := e.Fields[field]; !exists {
+		return false
+	}
+	delete(e.Fields, field)
+	e.commit()
+	return true
+}
+
+func (e *Entry) GetFields() map[string]string {
+	// e.Lock()
+	// defer e.Unlock()
+	fields := make(map[string]string, len(e.Fields))
+	for f, v := range e.Fields {
+		fields[f] = v
+	}
+	return fields
+}
+
+func getHash(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /hashes/{key}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(HashEntry) {
+		logger.Infof("Invalid request, entry is not a hash: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	j, err := json.Marshal(entry.GetFields())
+	if err != nil {
+		logger.Errorf("Error marshaling fields to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func getHashField(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /hashes/{key}/{field}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and field.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	field, exists := vars["field"]
+	if !exists {
+		logger.Info("Invalid request, no field specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(HashEntry) {
+		logger.Infof("Invalid request, entry is not a hash: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	value, exists := entry.GetField(field)
+	if !exists {
+		logger.Infof("Invalid request, field not found: %s - %s", key, field)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(value))
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func setHashField(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received PUT request to /hashes/{key}/{field}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and field.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	field, exists := vars["field"]
+	if !exists {
+		logger.Info("Invalid request, no field specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry if it exists.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Generating new hash entry for key: %s", key)
+		logger.Debugf("Received during GetEntry: %s", err)
+
+		//Didn't exist, make a new one!
+		entry = &Entry{Key: key, Type: HashEntry}
+		err = data.AddEntry(entry)
+		if err != nil {
+			logger.Debug(err)
+			entry, _ = data.GetEntry(key)
+		}
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(HashEntry) {
+		logger.Infof("Invalid request, entry is not a hash: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	//Fields may be written freely unless someone holds the lock.
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", key, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	//Get the new value.
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("Error reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	entry.SetField(field, string(bytes))
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func deleteHashField(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received DELETE request to /hashes/{key}/{field}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and field.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	field, exists := vars["field"]
+	if !exists {
+		logger.Info("Invalid request, no field specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(HashEntry) {
+		logger.Infof("Invalid request, entry is not a hash: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", key, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !entry.DeleteField(field) {
+		logger.Infof("Invalid request, field not found: %s - %s", key, field)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", key)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/mux"
+)
+
+type Revision struct {
+	Revision int64     `json:"revision"`
+	Value    string    `json:"value"`
+	Time     time.Time `json:"time"`
+}
+
+// addHistory records a revision, dropping the oldest ones beyond the
+// configured history length. The current value is always kept.
+func (e *Entry) addHistory(rev Revision) {
+	e.History = append(e.History, rev)
+
+	max := Config.App.HistoryLength
+	if max < 1 {
+		max = 1
+	}
+	if over := len(e.History) - max; over > 0 {
+		e.History = append([]Revision{}, e.History[over:]...)
+	}
+}
+
+func (e *Entry) GetRevision() int64 {
+	// e.Lock()
+	// defer e.Unlock()
+	return e.Revision
+}
+
+func (e *Entry) GetHistory() []Revision {
+	// e.Lock()
+	// defer e.Unlock()
+	history := make([]Revision, len(e.History))
+	copy(history, e.History)
+	return history
+}
+
+func (e *Entry) GetValueAt(revision int64) (string, bool) {
+	// e.Lock()
+	// defer e.Unlock()
+	if revision == e.Revision {
+		return e.Value, true
+	}
+	for _, r := range e.History {
+		if r.Revision == revision {
+			return r.Value, true
+		}
+	}
+	return "", false
+}
+
+func getVal(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /values/{key}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Parse the optional revision, an empty one means the current value.
+	//When watching, it is the revision to wait for a newer one than. It
+	//is always the entry's own revision, not a rev from the change feed.
+	var revision int64 = -1
+	if rev := r.FormValue("revision"); rev != "" {
+		var err error
+		revision, err = strconv.ParseInt(rev, 10, 64)
+		if err != nil || revision < 0 {
+			logger.Infof("Invalid revision query specified: %s", rev)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.FormValue("watch") == "true" {
+		changed, err := data.WaitForRevision(r.Context(), key, revision, time.Second*Config.App.TimeOut)
+		if err != nil && r.Context().Err() != nil {
+			logger.Infof("Watch given up on by the client for: %s", key)
+			return
+		}
+		if err != nil {
+			logger.Infof("Invalid request, entry key not found while watching: %s", key)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		//With no new revision in time, the current one is sent as is.
+		if !changed {
+			logger.Infof("Watch timed out with no new revision for: %s", key)
+		}
+		revision = -1
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid request, entry is not a string value: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if revision < 0 {
+		revision = entry.GetRevision()
+	}
+
+	value, exists := entry.GetValueAt(revision)
+	if !exists {
+		logger.Infof("Invalid request, revision not found: %s - %d", key, revision)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	reply := map[string]interface{}{"value": value, "revision": revision}
+	if entry.ContentType != "" {
+		reply["content_type"] = entry.ContentType
+	}
+
+	j, err := json.Marshal(reply)
+	if err != nil {
+		logger.Errorf("Error marshaling value to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func getValHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /values/{key}/history, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid request, entry is not a string value: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	j, err := json.Marshal(entry.GetHistory())
+	if err != nil {
+		logger.Errorf("Error marshaling history to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", key)
+}
@@ -0,0 +1,372 @@
+// The gRPC API, served on "grpc_port". Generate clients from this file
+// with protoc as usual. Field numbers are shared between messages where
+// they mean the same thing. The server's own Go code is generated into
+// httpdbpb, see the go:generate line in grpc.go.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: httpdb.proto
+
+package httpdbpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	HttpDB_Reserve_FullMethodName = "/httpdb.HttpDB/Reserve"
+	HttpDB_Put_FullMethodName     = "/httpdb.HttpDB/Put"
+	HttpDB_Update_FullMethodName  = "/httpdb.HttpDB/Update"
+	HttpDB_Release_FullMethodName = "/httpdb.HttpDB/Release"
+	HttpDB_Get_FullMethodName     = "/httpdb.HttpDB/Get"
+	HttpDB_Delete_FullMethodName  = "/httpdb.HttpDB/Delete"
+	HttpDB_Watch_FullMethodName   = "/httpdb.HttpDB/Watch"
+)
+
+// HttpDBClient is the client API for HttpDB service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type HttpDBClient interface {
+	// Reserve locks a key, waiting for it if someone else has it.
+	Reserve(ctx context.Context, in *KeyRequest, opts ...grpc.CallOption) (*Value, error)
+	// Put sets a key's value and reserves it, creating it if needed.
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*Value, error)
+	// Update sets the value of a reserved key, optionally releasing it.
+	Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*Value, error)
+	// Release gives up a reservation.
+	Release(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*Value, error)
+	// Get reads a key's value, or an older revision of it.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Value, error)
+	// Delete removes a key. A reserved key needs its lock_id.
+	Delete(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*Value, error)
+	// Watch streams every change to keys under a prefix.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Change], error)
+}
+
+type httpDBClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewHttpDBClient(cc grpc.ClientConnInterface) HttpDBClient {
+	return &httpDBClient{cc}
+}
+
+func (c *httpDBClient) Reserve(ctx context.Context, in *KeyRequest, opts ...grpc.CallOption) (*Value, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Value)
+	err := c.cc.Invoke(ctx, HttpDB_Reserve_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *httpDBClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*Value, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Value)
+	err := c.cc.Invoke(ctx, HttpDB_Put_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *httpDBClient) Update(ctx context.Context, in *UpdateRequest, opts ...grpc.CallOption) (*Value, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Value)
+	err := c.cc.Invoke(ctx, HttpDB_Update_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *httpDBClient) Release(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*Value, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Value)
+	err := c.cc.Invoke(ctx, HttpDB_Release_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *httpDBClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*Value, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Value)
+	err := c.cc.Invoke(ctx, HttpDB_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *httpDBClient) Delete(ctx context.Context, in *LockRequest, opts ...grpc.CallOption) (*Value, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Value)
+	err := c.cc.Invoke(ctx, HttpDB_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *httpDBClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Change], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &HttpDB_ServiceDesc.Streams[0], HttpDB_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, Change]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type HttpDB_WatchClient = grpc.ServerStreamingClient[Change]
+
+// HttpDBServer is the server API for HttpDB service.
+// All implementations must embed UnimplementedHttpDBServer
+// for forward compatibility.
+type HttpDBServer interface {
+	// Reserve locks a key, waiting for it if someone else has it.
+	Reserve(context.Context, *KeyRequest) (*Value, error)
+	// Put sets a key's value and reserves it, creating it if needed.
+	Put(context.Context, *PutRequest) (*Value, error)
+	// Update sets the value of a reserved key, optionally releasing it.
+	Update(context.Context, *UpdateRequest) (*Value, error)
+	// Release gives up a reservation.
+	Release(context.Context, *LockRequest) (*Value, error)
+	// Get reads a key's value, or an older revision of it.
+	Get(context.Context, *GetRequest) (*Value, error)
+	// Delete removes a key. A reserved key needs its lock_id.
+	Delete(context.Context, *LockRequest) (*Value, error)
+	// Watch streams every change to keys under a prefix.
+	Watch(*WatchRequest, grpc.ServerStreamingServer[Change]) error
+	mustEmbedUnimplementedHttpDBServer()
+}
+
+// UnimplementedHttpDBServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedHttpDBServer struct{}
+
+func (UnimplementedHttpDBServer) Reserve(context.Context, *KeyRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reserve not implemented")
+}
+func (UnimplementedHttpDBServer) Put(context.Context, *PutRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedHttpDBServer) Update(context.Context, *UpdateRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
+}
+func (UnimplementedHttpDBServer) Release(context.Context, *LockRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Release not implemented")
+}
+func (UnimplementedHttpDBServer) Get(context.Context, *GetRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedHttpDBServer) Delete(context.Context, *LockRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedHttpDBServer) Watch(*WatchRequest, grpc.ServerStreamingServer[Change]) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedHttpDBServer) mustEmbedUnimplementedHttpDBServer() {}
+func (UnimplementedHttpDBServer) testEmbeddedByValue()                {}
+
+// UnsafeHttpDBServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to HttpDBServer will
+// result in compilation errors.
+type UnsafeHttpDBServer interface {
+	mustEmbedUnimplementedHttpDBServer()
+}
+
+func RegisterHttpDBServer(s grpc.ServiceRegistrar, srv HttpDBServer) {
+	// If the following call pancis, it indicates UnimplementedHttpDBServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&HttpDB_ServiceDesc, srv)
+}
+
+func _HttpDB_Reserve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HttpDBServer).Reserve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HttpDB_Reserve_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HttpDBServer).Reserve(ctx, req.(*KeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HttpDB_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HttpDBServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HttpDB_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HttpDBServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HttpDB_Update_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HttpDBServer).Update(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HttpDB_Update_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HttpDBServer).Update(ctx, req.(*UpdateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HttpDB_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HttpDBServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HttpDB_Release_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HttpDBServer).Release(ctx, req.(*LockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HttpDB_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HttpDBServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HttpDB_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HttpDBServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HttpDB_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(HttpDBServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: HttpDB_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(HttpDBServer).Delete(ctx, req.(*LockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _HttpDB_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(HttpDBServer).Watch(m, &grpc.GenericServerStream[WatchRequest, Change]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type HttpDB_WatchServer = grpc.ServerStreamingServer[Change]
+
+// HttpDB_ServiceDesc is the grpc.ServiceDesc for HttpDB service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var HttpDB_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "httpdb.HttpDB",
+	HandlerType: (*HttpDBServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Reserve",
+			Handler:    _HttpDB_Reserve_Handler,
+		},
+		{
+			MethodName: "Put",
+			Handler:    _HttpDB_Put_Handler,
+		},
+		{
+			MethodName: "Update",
+			Handler:    _HttpDB_Update_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _HttpDB_Release_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _HttpDB_Get_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _HttpDB_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _HttpDB_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "httpdb.proto",
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+)
+
+// idempotentResponse is the response to the first request made with an
+// idempotency key. Until that request is done, ready is open and retries
+// wait on it.
+type idempotentResponse struct {
+	request string
+	ready   chan struct{}
+	expires time.Time
+
+	header http.Header
+	code   int
+	body   []byte
+}
+
+func (res *idempotentResponse) done() bool {
+	select {
+	case <-res.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// IdempotencyCache keeps the responses to mutating requests made with an
+// Idempotency-Key header, so a retry gets the same response back instead
+// of making the change again.
+type IdempotencyCache struct {
+	sync.Mutex
+	responses map[string]*idempotentResponse
+}
+
+var idempotency = &IdempotencyCache{responses: make(map[string]*idempotentResponse)}
+
+// Begin returns the response kept for key. If this is the first request
+// with it, the response is new and owned by the caller, which has to run
+// the request and Finish it.
+func (c *IdempotencyCache) Begin(key, request string) (*idempotentResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if res, exists := c.responses[key]; exists && (!res.done() || time.Now().Before(res.expires)) {
+		return res, false
+	}
+
+	res := &idempotentResponse{
+		request: request,
+		ready:   make(chan struct{}),
+		expires: time.Now().Add(time.Second * Config.App.IdempotencyWindow),
+	}
+	c.responses[key] = res
+	return res, true
+}
+
+// Finish keeps the response to the first request made with key. Server
+// errors aren't kept, so the request can be tried again.
+func (c *IdempotencyCache) Finish(key string, res *idempotentResponse, buf *bufferedResponse) {
+	c.Lock()
+	defer c.Unlock()
+
+	if buf.code >= 500 {
+		delete(c.responses, key)
+	} else {
+		res.header = buf.header
+		res.code = buf.code
+		res.body = buf.body.Bytes()
+	}
+	close(res.ready)
+}
+
+// Abandon frees key for the request to be tried again, when the first
+// one ended without a response.
+func (c *IdempotencyCache) Abandon(key string, res *idempotentResponse) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.responses[key] == res {
+		delete(c.responses, key)
+	}
+	close(res.ready)
+}
+
+// Expire drops every response kept for longer than the window.
+func (c *IdempotencyCache) Expire() int {
+	c.Lock()
+	defer c.Unlock()
+
+	count := 0
+	now := time.Now()
+	for key, res := range c.responses {
+		if res.done() && now.After(res.expires) {
+			delete(c.responses, key)
+			count++
+		}
+	}
+	return count
+}
+
+// fingerprint identifies a request, so a key reused for a different one
+// can be told apart from a retry.
+func fingerprint(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	return r.Method + " " + r.URL.RequestURI() + " " + hex.EncodeToString(sum[:])
+}
+
+// idempotentRoute answers retries of mutating requests that carry an
+// Idempotency-Key header with the response to the first one.
+func idempotentRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method == "GET" || r.Method == "HEAD" || streaming(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger.Errorf("Error occured reading request body: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		request := fingerprint(r, body)
+
+		var res *idempotentResponse
+		for {
+			var first bool
+			if res, first = idempotency.Begin(key, request); first {
+				break
+			}
+
+			if res.request != request {
+				logger.Infof("Invalid request, idempotency key reused for a different request: %s", key)
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+
+			//The first request may still be running.
+			select {
+			case <-res.ready:
+			case <-r.Context().Done():
+				return
+			}
+
+			//It failed, so this one is run instead.
+			if res.code == 0 {
+				continue
+			}
+
+			logger.Infof("Replaying response for idempotency key: %s", key)
+			for name, values := range res.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(replayedHeader, "true")
+			w.WriteHeader(res.code)
+			w.Write(res.body)
+			return
+		}
+
+		//A handler that panics never finishes, so the key is freed on the
+		//way out rather than left for every retry to wait on.
+		finished := false
+		defer func() {
+			if !finished {
+				idempotency.Abandon(key, res)
+			}
+		}()
+
+		buf := &bufferedResponse{header: make(http.Header)}
+		next.ServeHTTP(buf, r)
+		if buf.code == 0 {
+			buf.code = http.StatusOK
+		}
+		idempotency.Finish(key, res, buf)
+		finished = true
+
+		for name, values := range buf.header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(buf.code)
+		w.Write(buf.body.Bytes())
+	})
+}
+
+func startIdempotencyExpirer(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second * Config.App.IdempotencyWindow / 2)
+	defer ticker.Stop()
+
+	logger.Info("Started Idempotency Expirer Gouroutine.")
+	for {
+		select {
+
+		case <-ticker.C:
+			count := idempotency.Expire()
+			logger.Debugf("Expired %d idempotent responses.", count)
+
+		case <-stop:
+			logger.Info("Stopped Idempotency Expirer Goroutine.")
+			return
+
+		}
+	}
+}
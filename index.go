@@ -0,0 +1,278 @@
+package main
+
+import (
+	"github.com/google/btree"
+)
+
+// KeyRange is a span of keys in lexicographic order. An empty Start or
+// End leaves that side open. Start is included and End isn't, unless
+// StartExclusive or EndInclusive say otherwise.
+type KeyRange struct {
+	Start          string
+	End            string
+	StartExclusive bool
+	EndInclusive   bool
+	Reverse        bool
+}
+
+// PrefixRange is the range of keys starting with prefix.
+func PrefixRange(prefix string) *KeyRange {
+	r := &KeyRange{Start: prefix}
+
+	//The end is the prefix with its last byte bumped, after dropping any
+	//that can't be.
+	end := []byte(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) > 0 {
+		end[len(end)-1]++
+		r.End = string(end)
+	}
+	return r
+}
+
+// After narrows the range to the keys that come after cursor in the
+// range's order, for reading the next page.
+func (r KeyRange) After(cursor string) *KeyRange {
+	if cursor == "" {
+		return &r
+	}
+
+	if r.Reverse {
+		if r.End == "" || cursor <= r.End {
+			r.End = cursor
+			r.EndInclusive = false
+		}
+	} else if cursor >= r.Start {
+		r.Start = cursor
+		r.StartExclusive = true
+	}
+	return &r
+}
+
+// KeyOrder reads ranges of the DataStore's keys in order.
+type KeyOrder interface {
+	Range(r *KeyRange, offset, limit int) []string
+	Count(r *KeyRange) int
+}
+
+// keyIndexDegree is the degree of the KeyIndex B-tree, which sets how
+// many keys each of its nodes holds.
+const keyIndexDegree = 32
+
+// KeyIndex is every key in an in-memory DataStore in order, kept in a
+// B-tree so keys are added and removed in logarithmic time, and ranges
+// can be read without going over every key. It is guarded by the
+// DataStore lock.
+type KeyIndex struct {
+	tree *btree.BTreeG[string]
+}
+
+func NewKeyIndex() *KeyIndex {
+	return &KeyIndex{tree: btree.NewOrderedG[string](keyIndexDegree)}
+}
+
+func (x *KeyIndex) Insert(key string) {
+	if x == nil {
+		return
+	}
+	x.tree.ReplaceOrInsert(key)
+}
+
+func (x *KeyIndex) Remove(key string) {
+	if x == nil {
+		return
+	}
+	x.tree.Delete(key)
+}
+
+// walk calls fn for each key in the range, in its order, until fn
+// returns false.
+func (x *KeyIndex) walk(r *KeyRange, fn func(key string) bool) {
+	if r.Reverse {
+		visit := func(key string) bool {
+			if key < r.Start || (key == r.Start && r.StartExclusive) {
+				return false
+			}
+			if key == r.End && !r.EndInclusive {
+				return true
+			}
+			return fn(key)
+		}
+		if r.End == "" {
+			x.tree.Descend(visit)
+		} else {
+			x.tree.DescendLessOrEqual(r.End, visit)
+		}
+		return
+	}
+
+	x.tree.AscendGreaterOrEqual(r.Start, func(key string) bool {
+		if r.End != "" && (key > r.End || (key == r.End && !r.EndInclusive)) {
+			return false
+		}
+		if key == r.Start && r.StartExclusive {
+			return true
+		}
+		return fn(key)
+	})
+}
+
+// Range returns up to limit keys in the range, in its order, after
+// skipping offset of them. A limit below one returns them all.
+func (x *KeyIndex) Range(r *KeyRange, offset, limit int) []string {
+	keys := []string{}
+	x.walk(r, func(key string) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		keys = append(keys, key)
+		return limit < 1 || len(keys) < limit
+	})
+	return keys
+}
+
+func (x *KeyIndex) Count(r *KeyRange) int {
+	if r.Start == "" && r.End == "" {
+		return x.tree.Len()
+	}
+
+	count := 0
+	x.walk(r, func(key string) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// storeOrder reads ranges of keys straight from a Store.
+type storeOrder struct {
+	store Store
+}
+
+func (o storeOrder) Range(r *KeyRange, offset, limit int) []string {
+	keys := []string{}
+	err := o.store.Keys(r, func(key string) bool {
+		if offset > 0 {
+			offset--
+			return true
+		}
+		keys = append(keys, key)
+		return limit < 1 || len(keys) < limit
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+	return keys
+}
+
+func (o storeOrder) Count(r *KeyRange) int {
+	count := 0
+	err := o.store.Keys(r, func(key string) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		logger.Error(err)
+	}
+	return count
+}
+
+// Range returns up to limit entries in the range, in its order, along
+// with the last key it read if there may be more after it. Entries that
+// aren't cached are read straight from the Store, without caching them.
+// Keys deleted after they are read are made up for by reading more, so
+// only the end of the range cuts a page short.
+func (d *DataStore) Range(r *KeyRange, limit int) ([]*EntryState, string) {
+	states := []*EntryState{}
+	for {
+		want := 0
+		if limit > 0 {
+			want = limit - len(states)
+		}
+
+		d.Lock()
+		keys := d.ordered().Range(r, 0, want)
+		cached := make(map[string]*Entry)
+		for _, key := range keys {
+			if entry, exists := d.Entries[key]; exists {
+				cached[key] = entry
+			}
+		}
+		store := d.Store
+		d.Unlock()
+
+		for _, key := range keys {
+			if entry, exists := cached[key]; exists {
+				entry.Lock()
+				states = append(states, entry.State())
+				entry.Unlock()
+				continue
+			}
+
+			if store == nil {
+				continue
+			}
+			s, exists, err := store.Get(key)
+			if err != nil {
+				logger.Error(err)
+			}
+
+			//It may have been deleted since the keys were read.
+			if exists {
+				states = append(states, s)
+			}
+		}
+
+		if limit < 1 || len(keys) < want {
+			return states, ""
+		}
+		last := keys[len(keys)-1]
+		if len(states) == limit {
+			return states, last
+		}
+		r = r.After(last)
+	}
+}
+
+// RangeKeys returns up to limit keys in the range after skipping offset
+// of them, without reading their entries.
+func (d *DataStore) RangeKeys(r *KeyRange, offset, limit int) []string {
+	d.Lock()
+	defer d.Unlock()
+	return d.ordered().Range(r, offset, limit)
+}
+
+func (d *DataStore) CountRange(r *KeyRange) int {
+	d.Lock()
+	defer d.Unlock()
+	return d.ordered().Count(r)
+}
+
+// DeleteRange deletes every entry in the range, apart from locked ones,
+// which are returned. Anyone waiting to reserve a deleted key is told.
+func (d *DataStore) DeleteRange(r *KeyRange) (int, []string) {
+	deleted := []string{}
+	skipped := []string{}
+
+	d.Freeze(func() {
+		for _, key := range d.ordered().Range(r, 0, 0) {
+			//Locked entries are never evicted, so they are all cached.
+			if entry, cached := d.Entries[key]; cached && entry.IsLocked() {
+				skipped = append(skipped, key)
+				continue
+			}
+
+			d.unload(key)
+			logDelete(key)
+			deleted = append(deleted, key)
+		}
+	})
+
+	for _, key := range deleted {
+		deleteEntry <- AcquireAction{Key: key}
+	}
+	return len(deleted), skipped
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/btnmasher/random"
+)
+
+// listPage is the most keys handed out by a single listing.
+const listPage = 1000
+
+// KeyListing is one key in a listing. The value and lock status are only
+// filled in when asked for.
+type KeyListing struct {
+	Key      string    `json:"key"`
+	Type     EntryType `json:"type"`
+	Value    *string   `json:"value,omitempty"`
+	Revision int64     `json:"revision,omitempty"`
+	Locked   *bool     `json:"locked,omitempty"`
+}
+
+// List returns up to limit entries with keys starting with prefix and
+// coming after the key after, in key order, and the cursor for the next
+// page as Range does.
+func (d *DataStore) List(prefix, after string, limit int) ([]*EntryState, string) {
+	return d.Range(PrefixRange(prefix).After(after), limit)
+}
+
+// listPageQuery reads the limit and cursor a page of keys is asked for with.
+func listPageQuery(query url.Values) (int, string, error) {
+	limit := listPage
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, "", fmt.Errorf("bad limit: %s", v)
+		}
+		if limit > listPage {
+			limit = listPage
+		}
+	}
+
+	//The cursor is the last key of the previous page.
+	var after string
+	if v := query.Get("cursor"); v != "" {
+		key, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			return 0, "", fmt.Errorf("bad cursor: %s", v)
+		}
+		after = string(key)
+	}
+
+	return limit, after, nil
+}
+
+// writeListing sends a page of keys, with a cursor for the next one if
+// there may be more.
+func writeListing(w http.ResponseWriter, query url.Values, states []*EntryState, cursor string) {
+	withValues := query.Get("values") == "true"
+	withLocks := query.Get("locks") == "true"
+
+	keys := make([]*KeyListing, 0, len(states))
+	for _, s := range states {
+		k := &KeyListing{Key: s.Key, Type: s.Type}
+		if k.Type == "" {
+			k.Type = StringEntry
+		}
+		if withValues && k.Type == StringEntry {
+			value := s.Value
+			k.Value = &value
+			k.Revision = s.Revision
+		}
+		if withLocks {
+			locked := s.LockId != ""
+			k.Locked = &locked
+		}
+		keys = append(keys, k)
+	}
+
+	body := map[string]interface{}{"keys": keys}
+	if cursor != "" {
+		body["cursor"] = base64.RawURLEncoding.EncodeToString([]byte(cursor))
+	}
+
+	j, err := json.Marshal(body)
+	if err != nil {
+		logger.Errorf("Error marshaling key listing to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+}
+
+func listValues(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /values, request id: %s", random.String(5))
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	limit, after, err := listPageQuery(query)
+	if err != nil {
+		logger.Infof("Invalid request, %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	states, cursor := data.List(prefix, after, limit)
+	writeListing(w, query, states, cursor)
+	logger.Infof("Handled successful request for %d keys with prefix: %s", len(states), prefix)
+}
+
+// rangeQuery reads the range of keys a request is for.
+func rangeQuery(query url.Values) (*KeyRange, error) {
+	r := &KeyRange{Start: query.Get("start"), End: query.Get("end")}
+
+	flags := map[string]*bool{
+		"start_exclusive": &r.StartExclusive,
+		"end_inclusive":   &r.EndInclusive,
+		"reverse":         &r.Reverse,
+	}
+	for name, flag := range flags {
+		switch query.Get(name) {
+		case "true":
+			*flag = true
+		case "", "false":
+		default:
+			return nil, fmt.Errorf("bad %s query: %s", name, query.Get(name))
+		}
+	}
+
+	return r, nil
+}
+
+func getRange(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /range, request id: %s", random.String(5))
+
+	query := r.URL.Query()
+	keyRange, err := rangeQuery(query)
+	if err != nil {
+		logger.Infof("Invalid request, %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("count") == "true" {
+		count := data.CountRange(keyRange)
+
+		j, err := json.Marshal(map[string]int{"count": count})
+		if err != nil {
+			logger.Errorf("Error marshaling range count to json: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(j)
+		logger.Infof("Handled successful count of %d keys in range.", count)
+		return
+	}
+
+	limit, after, err := listPageQuery(query)
+	if err != nil {
+		logger.Infof("Invalid request, %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	states, cursor := data.Range(keyRange.After(after), limit)
+	writeListing(w, query, states, cursor)
+	logger.Infof("Handled successful request for %d keys in range.", len(states))
+}
+
+func deleteRange(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received DELETE request to /range, request id: %s", random.String(5))
+
+	query := r.URL.Query()
+	keyRange, err := rangeQuery(query)
+	if err != nil {
+		logger.Infof("Invalid request, %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Deleting everything takes asking for it.
+	if keyRange.Start == "" && keyRange.End == "" && query.Get("all") != "true" {
+		logger.Info("Invalid request, no range specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	deleted, skipped := data.DeleteRange(keyRange)
+
+	j, err := json.Marshal(map[string]interface{}{"deleted": deleted, "skipped": skipped})
+	if err != nil {
+		logger.Errorf("Error marshaling range delete results to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful delete of %d keys in range, skipped %d locked.", deleted, len(skipped))
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +18,7 @@ import (
 
 var (
 	configFile string
+	serverUrl  string
 	logger     *lumberjack.Logger
 
 	Config struct {
@@ -26,14 +28,40 @@ var (
 	done     chan struct{}
 	data     DataStore
 	locks    LockStore
+	wal      *WriteAheadLog
+	changes  *ChangeLog
 	showconf *bool
 )
 
 type AppSettings struct {
-	Port         int           `json:"port"`
-	Debug        bool          `json:"debug"`
-	TimeOut      time.Duration `json:"timeout"`
-	AtomicBuffer int           `json:"atomic_buffer"`
+	Port              int               `json:"port"`
+	Debug             bool              `json:"debug"`
+	TimeOut           time.Duration     `json:"timeout"`
+	AtomicBuffer      int               `json:"atomic_buffer"`
+	VisibilityTimeOut time.Duration     `json:"visibility_timeout"`
+	HistoryLength     int               `json:"history_length"`
+	WALPath           string            `json:"wal_path"`
+	WALFsync          string            `json:"wal_fsync"`
+	WALLocks          bool              `json:"wal_locks"`
+	SnapshotDir       string            `json:"snapshot_dir"`
+	SnapshotInterval  time.Duration     `json:"snapshot_interval"`
+	Store             string            `json:"store"`
+	StorePath         string            `json:"store_path"`
+	CacheIdle         time.Duration     `json:"cache_idle"`
+	Leader            string            `json:"leader"`
+	ChangeLogSize     int               `json:"change_log_size"`
+	ClusterId         string            `json:"cluster_id"`
+	ClusterPeers      map[string]string `json:"cluster_peers"`
+	RaftPath          string            `json:"raft_path"`
+	RaftSnapshot      int               `json:"raft_snapshot_entries"`
+	WebhooksPath      string            `json:"webhooks_path"`
+	ShardId           string            `json:"shard_id"`
+	ShardNodes        map[string]string `json:"shard_nodes"`
+	ShardVNodes       int               `json:"shard_vnodes"`
+	IdempotencyWindow time.Duration     `json:"idempotency_window"`
+	GRPCPort          int               `json:"grpc_port"`
+	RESPPort          int               `json:"resp_port"`
+	SessionOrigins    []string          `json:"session_origins"`
 }
 
 func init() {
@@ -41,6 +69,8 @@ func init() {
 
 	showconf = flag.Bool("showconf", false, "prints the configuration and exists.")
 
+	flag.StringVar(&serverUrl, "server", "", "the server the import and export commands talk to")
+
 	flag.Parse()
 
 	logger = lumberjack.NewLoggerWithDefaults()
@@ -60,10 +90,65 @@ func main() {
 		showConfig()
 	}
 
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	changes = NewChangeLog(Config.App.ChangeLogSize)
+
+	loadStore()
+	loadCluster()
+	loadShards()
+	loadWebhooks()
+
+	if cluster == nil {
+		loadSnapshot()
+		loadWAL()
+	}
+
 	logger.Info("Starting Goroutines.")
 	go startServer()
 	go startAtomics(done)
 	go startLockMinder(done)
+	go startWebhooks(done)
+	go startIdempotencyExpirer(done)
+	go startEntryExpirer(done)
+
+	if wal != nil && Config.App.WALFsync == FsyncInterval {
+		go startWALSyncer(done)
+	}
+
+	if cluster != nil {
+		go startCluster(done)
+		go startRaftSnapshotter(done)
+	}
+
+	if Config.App.GRPCPort > 0 {
+		go startRPCServer(done)
+	}
+	if Config.App.RESPPort > 0 {
+		go startRESPServer(done)
+	}
+
+	if Config.App.SnapshotDir != "" && Config.App.SnapshotInterval > 0 && cluster == nil {
+		go startSnapshotter(done)
+	}
+
+	if data.Store != nil {
+		go startCacheEvictor(done)
+	}
+
+	if shards != nil {
+		go startRebalancer(done)
+	}
+
+	if Config.App.Leader != "" {
+		replica.leader = Config.App.Leader
+		go startFollower(done)
+	}
 
 	signalChannel := make(chan os.Signal, 2)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
@@ -79,6 +164,14 @@ func main() {
 
 	time.Sleep(time.Second * 1)
 
+	if wal != nil {
+		wal.Close()
+	}
+
+	if data.Store != nil {
+		data.Store.Close()
+	}
+
 	logger.Info("======== Application Exit ========")
 
 }
@@ -100,6 +193,62 @@ func loadConfig() {
 		Config.App.TimeOut = 5
 	}
 
+	if Config.App.VisibilityTimeOut <= 0 {
+		Config.App.VisibilityTimeOut = 30
+	}
+
+	if Config.App.HistoryLength < 1 {
+		Config.App.HistoryLength = 10
+	}
+
+	switch Config.App.WALFsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		Config.App.WALFsync = FsyncInterval
+		logger.Warn("WAL fsync policy invalid or not specified in config, defaulting to interval.")
+	}
+
+	switch Config.App.Store {
+	case StoreMemory, StoreFile:
+	default:
+		Config.App.Store = StoreMemory
+		logger.Warn("Store invalid or not specified in config, defaulting to memory.")
+	}
+
+	if Config.App.StorePath == "" {
+		Config.App.StorePath = "httpdb.db"
+	}
+
+	if Config.App.CacheIdle <= 0 {
+		Config.App.CacheIdle = 300
+	}
+
+	Config.App.Leader = strings.TrimRight(Config.App.Leader, "/")
+
+	if Config.App.RaftPath == "" {
+		Config.App.RaftPath = "httpdb.raft"
+	}
+
+	if Config.App.WebhooksPath == "" {
+		Config.App.WebhooksPath = "httpdb.webhooks"
+	}
+
+	if Config.App.RaftSnapshot < 1 {
+		Config.App.RaftSnapshot = 10000
+	}
+
+	if Config.App.ShardVNodes < 1 {
+		Config.App.ShardVNodes = 64
+	}
+
+	if Config.App.IdempotencyWindow <= 0 {
+		Config.App.IdempotencyWindow = 300
+	}
+
+	if Config.App.ChangeLogSize < 1 {
+		Config.App.ChangeLogSize = 10000
+	}
+
 	if Config.App.AtomicBuffer < 1 {
 		Config.App.AtomicBuffer = 1
 		logger.Warn("Atomic buffer invalid or not specified in config, defaulting to 1.")
@@ -118,9 +267,71 @@ func showConfig() {
 func regHandlers(r *mux.Router) {
 	logger.Info("Registering http handler routes...")
 
+	r.Use(followerRedirect)
+	r.Use(clusterRoute)
+	r.Use(shardRoute)
+	r.Use(idempotentRoute)
+
 	r.HandleFunc("/reservations/{key}", reserveKey).Methods("POST")
+	r.HandleFunc("/values", listValues).Methods("GET")
+	r.HandleFunc("/values/{key}", getVal).Methods("GET")
 	r.HandleFunc("/values/{key}", putVal).Methods("PUT")
+	r.HandleFunc("/values/{key}/history", getValHistory).Methods("GET")
 	r.HandleFunc("/values/{key}/{lock_id}", updateVal).Methods("POST")
+	r.HandleFunc("/range", getRange).Methods("GET")
+	r.HandleFunc("/range", deleteRange).Methods("DELETE")
+	r.HandleFunc("/batch/get", batchGetValues).Methods("POST")
+	r.HandleFunc("/batch/put", batchPutValues).Methods("POST")
+	r.HandleFunc("/txn", runTxn).Methods("POST")
+
+	r.HandleFunc("/hashes/{key}", getHash).Methods("GET")
+	r.HandleFunc("/hashes/{key}/{field}", getHashField).Methods("GET")
+	r.HandleFunc("/hashes/{key}/{field}", setHashField).Methods("PUT")
+	r.HandleFunc("/hashes/{key}/{field}", deleteHashField).Methods("DELETE")
+
+	r.HandleFunc("/sets", combineSets).Methods("GET")
+	r.HandleFunc("/sets/{key}", getSetMembers).Methods("GET")
+	r.HandleFunc("/sets/{key}/count", getSetCardinality).Methods("GET")
+	r.HandleFunc("/sets/{key}/members/{member}", isSetMember).Methods("GET")
+	r.HandleFunc("/sets/{key}/members/{member}", addSetMember).Methods("PUT")
+	r.HandleFunc("/sets/{key}/members/{member}", removeSetMember).Methods("DELETE")
+
+	r.HandleFunc("/zsets/{key}", getZSetRange).Methods("GET")
+	r.HandleFunc("/zsets/{key}/members/{member}", getZSetMember).Methods("GET")
+	r.HandleFunc("/zsets/{key}/members/{member}", setZSetMember).Methods("PUT")
+	r.HandleFunc("/zsets/{key}/members/{member}", removeZSetMember).Methods("DELETE")
+
+	r.HandleFunc("/queues/{name}", getQueueStats).Methods("GET")
+	r.HandleFunc("/queues/{name}", enqueueMessage).Methods("POST")
+	r.HandleFunc("/queues/{name}/receive", receiveMessage).Methods("POST")
+	r.HandleFunc("/queues/{name}/receipts/{receipt}", ackMessage).Methods("DELETE")
+	r.HandleFunc("/queues/{name}/receipts/{receipt}/nack", nackMessage).Methods("POST")
+
+	r.HandleFunc("/admin/backup", backupData).Methods("GET")
+	r.HandleFunc("/admin/restore", restoreData).Methods("POST")
+	r.HandleFunc("/admin/webhooks", listWebhooks).Methods("GET")
+	r.HandleFunc("/admin/webhooks", addWebhook).Methods("POST")
+	r.HandleFunc("/admin/webhooks/{id}", deleteWebhook).Methods("DELETE")
+
+	r.HandleFunc("/bulk/export", exportValues).Methods("GET")
+	r.HandleFunc("/bulk/import", importValues).Methods("POST")
+
+	r.HandleFunc("/changes", getChanges).Methods("GET")
+	r.HandleFunc("/watch", watchEvents).Methods("GET")
+	r.HandleFunc("/sessions", openSession).Methods("GET")
+
+	r.HandleFunc("/replication/snapshot", replicationSnapshot).Methods("GET")
+	r.HandleFunc("/replication/stream", replicationStream).Methods("GET")
+	r.HandleFunc("/admin/promote", promote).Methods("POST")
+
+	r.HandleFunc("/raft/vote", raftRpc).Methods("POST")
+	r.HandleFunc("/raft/append", raftRpc).Methods("POST")
+	r.HandleFunc("/raft/snapshot", raftRpc).Methods("POST")
+	r.HandleFunc("/cluster/status", getClusterStatus).Methods("GET")
+
+	r.HandleFunc("/shard/status", getShardStatus).Methods("GET")
+	r.HandleFunc("/shard/entries", adoptEntry).Methods("POST")
+	r.HandleFunc("/shard/nodes/{id}", setShardNode).Methods("PUT", "DELETE")
 }
 
 func startServer() {
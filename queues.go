@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/mux"
+)
+
+// A received message is leased much like a lock: it carries a Receipt
+// until it is acked, nacked, or VisibleAt passes and it can be received
+// again by someone else.
+type QueueMessage struct {
+	Id        string    `json:"id"`
+	Body      string    `json:"body"`
+	Receipt   string    `json:"receipt,omitempty"`
+	VisibleAt time.Time `json:"visible_at"`
+	Receives  int       `json:"receives"`
+}
+
+func (e *Entry) Enqueue(body string) *QueueMessage {
+	// e.Lock()
+	// defer e.Unlock()
+	m := &QueueMessage{
+		Id:        random.String(10),
+		Body:      body,
+		VisibleAt: time.Now(),
+	}
+	e.Messages = append(e.Messages, m)
+	e.commit()
+	return m
+}
+
+// Receive leases the oldest visible message, or returns nil if there is none.
+func (e *Entry) Receive(visibility time.Duration) *QueueMessage {
+	// e.Lock()
+	// defer e.Unlock()
+	now := time.Now()
+	for _, m := range e.Messages {
+		if m.VisibleAt.After(now) {
+			continue
+		}
+		m.Receipt = random.String(10)
+		m.VisibleAt = now.Add(visibility)
+		m.Receives++
+		e.commit()
+		c := *m
+		return &c
+	}
+	return nil
+}
+
+// leased finds the message still held under the given receipt. A lease
+// that has expired is no longer valid, even if nobody re-received it yet.
+func (e *Entry) leased(receipt string) int {
+	now := time.Now()
+	for i, m := range e.Messages {
+		if m.Receipt == receipt && m.VisibleAt.After(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *Entry) Ack(receipt string) bool {
+	// e.Lock()
+	// defer e.Unlock()
+	i := e.leased(receipt)
+	if i < 0 {
+		return false
+	}
+	e.Messages = append(e.Messages[:i], e.Messages[i+1:]...)
+	e.commit()
+	return true
+}
+
+func (e *Entry) Nack(receipt string) bool {
+	// e.Lock()
+	// defer e.Unlock()
+	i := e.leased(receipt)
+	if i < 0 {
+		return false
+	}
+	e.Messages[i].Receipt = ""
+	e.Messages[i].VisibleAt = time.Now()
+	e.commit()
+	return true
+}
+
+func (e *Entry) InFlight() int {
+	// e.Lock()
+	// defer e.Unlock()
+	now := time.Now()
+	count := 0
+	for _, m := range e.Messages {
+		if m.VisibleAt.After(now) {
+			count++
+		}
+	}
+	return count
+}
+
+// getQueueEntry fetches the queue named in the request, writing the
+// error response itself and returning nil when there isn't one.
+func getQueueEntry(w http.ResponseWriter, name string) *Entry {
+	entry, err := data.GetEntry(name)
+	if err != nil {
+		logger.Infof("Invalid request, queue not found: %s", name)
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	entry.Lock()
+
+	if !entry.IsType(QueueEntry) {
+		entry.Unlock()
+		logger.Infof("Invalid request, entry is not a queue: %s", name)
+		w.WriteHeader(http.StatusConflict)
+		return nil
+	}
+
+	return entry
+}
+
+func getQueueStats(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /queues/{name}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	name := vars["name"]
+
+	entry := getQueueEntry(w, name)
+	if entry == nil {
+		return
+	}
+	defer entry.Unlock()
+
+	j, err := json.Marshal(map[string]int{
+		"messages":  len(entry.Messages),
+		"in_flight": entry.InFlight(),
+	})
+	if err != nil {
+		logger.Errorf("Error marshaling queue stats to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", name)
+}
+
+func enqueueMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received POST request to /queues/{name}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	name := vars["name"]
+
+	//Get the new message.
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("Error reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	//Make the queue if it doesn't exist yet.
+	if !data.EntryExists(name) {
+		logger.Infof("Generating new queue entry for name: %s", name)
+		err = data.AddEntry(&Entry{Key: name, Type: QueueEntry})
+		if err != nil {
+			logger.Debug(err)
+		}
+	}
+
+	entry := getQueueEntry(w, name)
+	if entry == nil {
+		return
+	}
+	defer entry.Unlock()
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", name, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	m := entry.Enqueue(string(bytes))
+
+	j, err := json.Marshal(map[string]string{"id": m.Id})
+	if err != nil {
+		logger.Errorf("Error marshaling message id to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", name)
+}
+
+func receiveMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received POST request to /queues/{name}/receive, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	name := vars["name"]
+
+	//Parse the optional visibility timeout, in the same units as the config.
+	visibility := Config.App.VisibilityTimeOut
+	if v := r.FormValue("visibility"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			logger.Infof("Invalid visibility query specified: %s", v)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		visibility = time.Duration(secs)
+	}
+
+	entry := getQueueEntry(w, name)
+	if entry == nil {
+		return
+	}
+	defer entry.Unlock()
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", name, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	m := entry.Receive(time.Second * visibility)
+	if m == nil {
+		logger.Debugf("No visible messages in queue: %s", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	j, err := json.Marshal(m)
+	if err != nil {
+		logger.Errorf("Error marshaling message to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", name)
+}
+
+func ackMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received DELETE request to /queues/{name}/receipts/{receipt}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	name, receipt := vars["name"], vars["receipt"]
+
+	entry := getQueueEntry(w, name)
+	if entry == nil {
+		return
+	}
+	defer entry.Unlock()
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", name, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !entry.Ack(receipt) {
+		logger.Infof("Invalid request, receipt not found or expired: %s - %s", name, receipt)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", name)
+}
+
+func nackMessage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received POST request to /queues/{name}/receipts/{receipt}/nack, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	name, receipt := vars["name"], vars["receipt"]
+
+	entry := getQueueEntry(w, name)
+	if entry == nil {
+		return
+	}
+	defer entry.Unlock()
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", name, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !entry.Nack(receipt) {
+		logger.Infof("Invalid request, receipt not found or expired: %s - %s", name, receipt)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", name)
+}
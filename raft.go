@@ -0,0 +1,1075 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RaftFollower  = "follower"
+	RaftCandidate = "candidate"
+	RaftLeader    = "leader"
+
+	raftTick        = time.Millisecond * 10
+	raftHeartbeat   = time.Millisecond * 50
+	raftElectionMin = time.Millisecond * 300
+	raftBatch       = 256
+
+	//Sending a whole snapshot can take a lot longer than an append.
+	raftSnapshotTimeout = time.Second * 30
+)
+
+// RaftEntry is one slot of the replicated log. A nil Record is the no-op
+// every new leader appends to commit what came before it.
+type RaftEntry struct {
+	Term   int64      `json:"term"`
+	Index  int64      `json:"index"`
+	Record *WALRecord `json:"record,omitempty"`
+}
+
+type VoteRequest struct {
+	Term      int64  `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex int64  `json:"last_index"`
+	LastTerm  int64  `json:"last_term"`
+}
+
+type VoteResponse struct {
+	Term    int64 `json:"term"`
+	Granted bool  `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term      int64        `json:"term"`
+	Leader    string       `json:"leader"`
+	PrevIndex int64        `json:"prev_index"`
+	PrevTerm  int64        `json:"prev_term"`
+	Entries   []*RaftEntry `json:"entries,omitempty"`
+	Commit    int64        `json:"commit"`
+}
+
+// AppendResponse carries the follower's last index so a leader can skip
+// straight back to it instead of probing one entry at a time.
+type AppendResponse struct {
+	Term      int64 `json:"term"`
+	Success   bool  `json:"success"`
+	LastIndex int64 `json:"last_index"`
+}
+
+// SnapshotRequest hands a follower the leader's latest snapshot, when the
+// entries it is missing have already been compacted away.
+type SnapshotRequest struct {
+	Term      int64  `json:"term"`
+	Leader    string `json:"leader"`
+	LastIndex int64  `json:"last_index"`
+	LastTerm  int64  `json:"last_term"`
+	Data      []byte `json:"data"`
+}
+
+type SnapshotResponse struct {
+	Term    int64 `json:"term"`
+	Success bool  `json:"success"`
+}
+
+// raftRecord is one line of a node's persisted state. The log is only
+// ever appended to, with truncations written as records of their own,
+// until it is compacted and written out again behind a snapshot.
+type raftRecord struct {
+	Op    string     `json:"op"`
+	Term  int64      `json:"term,omitempty"`
+	Vote  string     `json:"vote,omitempty"`
+	Index int64      `json:"index,omitempty"`
+	Entry *RaftEntry `json:"entry,omitempty"`
+}
+
+// RaftNode is one member of a Raft cluster. Peers are reached over HTTP
+// at /raft/vote, /raft/append and /raft/snapshot under their base URL,
+// and the node serves the same paths itself. Committed records are handed
+// to apply in log order, except those the node put in its own log as
+// leader, which it has already applied. When the node can no longer trust
+// what it has applied, after losing leadership, on startup, or when it is
+// sent a snapshot, it calls reset with the states in its latest snapshot
+// and applies the committed log after it again.
+//
+// The log starts at base, the last entry the snapshot covers, which is
+// kept as log[0] for its term. Everything before it is gone.
+type RaftNode struct {
+	sync.Mutex
+	Id string
+
+	peers  map[string]string
+	apply  func(*WALRecord)
+	reset  func([]*EntryState)
+	path   string
+	file   *os.File
+	client *http.Client
+	snap   []byte
+
+	state     string
+	term      int64
+	votedFor  string
+	leader    string
+	log       []*RaftEntry
+	base      int64
+	commit    int64
+	applied   int64
+	rebuild   bool
+	termStart int64
+	stopped   bool
+
+	next    map[string]int64
+	match   map[string]int64
+	acked   map[string]time.Time
+	sending map[string]bool
+
+	heard    time.Time
+	timeout  time.Duration
+	lastBeat time.Time
+
+	cond *sync.Cond
+	kick chan struct{}
+}
+
+// NewRaftNode creates a node with the given peers, keyed by id and not
+// including itself. State is persisted to path, unless it is empty, with
+// the snapshot next to it in path + ".snap".
+func NewRaftNode(id string, peers map[string]string, path string, apply func(*WALRecord), reset func([]*EntryState)) (*RaftNode, error) {
+	n := &RaftNode{
+		Id:      id,
+		peers:   peers,
+		apply:   apply,
+		reset:   reset,
+		path:    path,
+		client:  &http.Client{Timeout: time.Second},
+		state:   RaftFollower,
+		log:     []*RaftEntry{{}},
+		rebuild: true,
+		heard:   time.Now(),
+		timeout: electionTimeout(),
+		kick:    make(chan struct{}, 1),
+	}
+	n.cond = sync.NewCond(&n.Mutex)
+
+	if path != "" {
+		if err := n.load(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+func electionTimeout() time.Duration {
+	return raftElectionMin + time.Duration(rand.Int63n(int64(raftElectionMin)))
+}
+
+func (n *RaftNode) load(path string) error {
+	//The snapshot is only checked here, and read again when it's applied.
+	snap, err := ReadSnapshot(path + ".snap")
+	if err == nil {
+		n.base, n.commit = snap.Index, snap.Index
+		n.log = []*RaftEntry{{Term: snap.Term, Index: snap.Index}}
+	} else if _, missing := os.Stat(path + ".snap"); !os.IsNotExist(missing) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open raft log: %s", err)
+	}
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+
+		var rec raftRecord
+		if err == nil {
+			err = json.Unmarshal(line, &rec)
+		}
+		if err != nil {
+			//Only the final record may be torn.
+			if _, peek := reader.Peek(1); peek != io.EOF {
+				file.Close()
+				return fmt.Errorf("Corrupt record at offset %d of %s: %s", offset, path, err)
+			}
+			logger.Warnf("Truncating torn record at offset %d of %s.", offset, path)
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return err
+			}
+			break
+		}
+
+		switch rec.Op {
+		case "state":
+			n.term, n.votedFor = rec.Term, rec.Vote
+		case "entry":
+			//Entries the snapshot covers may outlive it if compacting
+			//was cut short.
+			if rec.Entry.Index > n.base {
+				n.log = append(n.log, rec.Entry)
+			}
+		case "truncate":
+			if rec.Index > n.base {
+				n.log = n.log[:rec.Index-n.base]
+			}
+		}
+		offset += int64(len(line))
+	}
+
+	n.file = file
+	return nil
+}
+
+// persist writes records and syncs them before anything is acted on.
+// Expects the node lock to be held.
+func (n *RaftNode) persist(recs ...*raftRecord) {
+	if n.file == nil || len(recs) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		enc.Encode(rec)
+	}
+
+	if _, err := n.file.Write(buf.Bytes()); err != nil {
+		logger.Errorf("Unable to write raft log: %s", err)
+		return
+	}
+	if err := n.file.Sync(); err != nil {
+		logger.Errorf("Unable to sync raft log: %s", err)
+	}
+}
+
+func (n *RaftNode) persistState() {
+	n.persist(&raftRecord{Op: "state", Term: n.term, Vote: n.votedFor})
+}
+
+// saveSnapshot replaces the snapshot with an encoded one, which is only
+// kept in memory when the node isn't persisted. Expects the node lock to
+// be held.
+func (n *RaftNode) saveSnapshot(encoded []byte) error {
+	if n.path == "" {
+		n.snap = encoded
+		return nil
+	}
+
+	tmp := n.path + ".snap.tmp"
+	if err := writeSynced(tmp, encoded, 0644); err != nil {
+		return fmt.Errorf("Unable to write raft snapshot: %s", err)
+	}
+	if err := os.Rename(tmp, n.path+".snap"); err != nil {
+		return fmt.Errorf("Unable to rename raft snapshot: %s", err)
+	}
+	return nil
+}
+
+// readSnapshot returns the encoded snapshot, or nil if there isn't one.
+// Expects the node lock to be held.
+func (n *RaftNode) readSnapshot() ([]byte, error) {
+	if n.base == 0 {
+		return nil, nil
+	}
+	if n.path == "" {
+		return n.snap, nil
+	}
+	encoded, err := ioutil.ReadFile(n.path + ".snap")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read raft snapshot: %s", err)
+	}
+	return encoded, nil
+}
+
+// rewrite writes the log out again from base, in place of everything the
+// snapshot now covers. Expects the node lock to be held.
+func (n *RaftNode) rewrite() error {
+	if n.file == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.Encode(&raftRecord{Op: "state", Term: n.term, Vote: n.votedFor})
+	for _, e := range n.log[1:] {
+		enc.Encode(&raftRecord{Op: "entry", Entry: e})
+	}
+
+	tmp := n.path + ".tmp"
+	if err := writeSynced(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("Unable to compact raft log: %s", err)
+	}
+	if err := os.Rename(tmp, n.path); err != nil {
+		return fmt.Errorf("Unable to rename raft log: %s", err)
+	}
+
+	file, err := os.OpenFile(n.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open raft log: %s", err)
+	}
+	n.file.Close()
+	n.file = file
+	return nil
+}
+
+// writeSynced writes b to a new file at path, and syncs it.
+func writeSynced(path string, b []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(b); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (n *RaftNode) lastIndex() int64 {
+	return n.base + int64(len(n.log)-1)
+}
+
+// entry returns the log entry at index, which can't be before base.
+func (n *RaftNode) entry(index int64) *RaftEntry {
+	return n.log[index-n.base]
+}
+
+// Status returns the node's role, term, and the leader it knows of.
+func (n *RaftNode) Status() (string, int64, string) {
+	n.Lock()
+	defer n.Unlock()
+	return n.state, n.term, n.leader
+}
+
+func (n *RaftNode) PeerUrl(id string) string {
+	return n.peers[id]
+}
+
+// Run drives elections, heartbeats and applying committed records until
+// stop is closed.
+func (n *RaftNode) Run(stop chan struct{}) {
+	ticker := time.NewTicker(raftTick)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-ticker.C:
+			n.tick()
+
+		case <-n.kick:
+			n.Lock()
+			if n.state == RaftLeader {
+				n.broadcast()
+			}
+			n.Unlock()
+
+		case <-stop:
+			n.Lock()
+			n.stopped = true
+			n.state = RaftFollower
+			if n.file != nil {
+				n.file.Close()
+				n.file = nil
+			}
+			n.cond.Broadcast()
+			n.Unlock()
+			return
+
+		}
+
+		n.applyCommitted()
+	}
+}
+
+func (n *RaftNode) tick() {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.state == RaftLeader {
+		if time.Since(n.lastBeat) >= raftHeartbeat {
+			n.broadcast()
+		}
+		return
+	}
+
+	if time.Since(n.heard) >= n.timeout {
+		n.startElection()
+	}
+}
+
+// applyCommitted hands newly committed records to apply, outside the node
+// lock so apply is free to take whatever locks it needs.
+func (n *RaftNode) applyCommitted() {
+	n.Lock()
+	rebuild := n.rebuild
+	var states []*EntryState
+	if rebuild {
+		encoded, err := n.readSnapshot()
+		if err == nil && encoded != nil {
+			var snap *Snapshot
+			if snap, err = DecodeSnapshot(bytes.NewReader(encoded), "raft snapshot"); err == nil {
+				states = snap.Entries
+			}
+		}
+		if err != nil {
+			//Try again on the next tick rather than apply onto nothing.
+			n.Unlock()
+			logger.Error(err)
+			return
+		}
+		n.rebuild = false
+		n.applied = n.base
+	}
+	from, to := n.applied+1, n.commit
+	entries := append([]*RaftEntry{}, n.log[from-n.base:to-n.base+1]...)
+	leading := n.state == RaftLeader
+	termStart := n.termStart
+	n.Unlock()
+
+	if rebuild && n.reset != nil {
+		n.reset(states)
+	}
+
+	for _, e := range entries {
+		if e.Record == nil || (leading && e.Index >= termStart) {
+			continue
+		}
+		n.apply(e.Record)
+	}
+
+	n.Lock()
+	if !n.rebuild {
+		n.applied = to
+	}
+	n.cond.Broadcast()
+	n.Unlock()
+}
+
+// The methods below expect the node lock to be held.
+
+func (n *RaftNode) startElection() {
+	n.state = RaftCandidate
+	n.term++
+	n.votedFor = n.Id
+	n.leader = ""
+	n.heard = time.Now()
+	n.timeout = electionTimeout()
+	n.persistState()
+
+	term := n.term
+	req := &VoteRequest{
+		Term:      term,
+		Candidate: n.Id,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.entry(n.lastIndex()).Term,
+	}
+
+	logger.Debugf("Raft node %s starting election for term %d.", n.Id, term)
+
+	votes := 1
+	if votes*2 > len(n.peers)+1 {
+		n.becomeLeader()
+		return
+	}
+
+	for _, url := range n.peers {
+		go func(url string) {
+			var resp VoteResponse
+			if err := n.call(url+"/raft/vote", req, &resp); err != nil {
+				return
+			}
+
+			n.Lock()
+			defer n.Unlock()
+
+			if resp.Term > n.term {
+				n.stepDown(resp.Term)
+				return
+			}
+			if n.state != RaftCandidate || n.term != term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes*2 > len(n.peers)+1 {
+				n.becomeLeader()
+			}
+		}(url)
+	}
+}
+
+func (n *RaftNode) becomeLeader() {
+	logger.Infof("Raft node %s is leader for term %d.", n.Id, n.term)
+
+	n.state = RaftLeader
+	n.leader = n.Id
+	n.next = make(map[string]int64)
+	n.match = make(map[string]int64)
+	n.acked = make(map[string]time.Time)
+	n.sending = make(map[string]bool)
+	for id := range n.peers {
+		n.next[id] = n.lastIndex() + 1
+	}
+
+	//Entries from earlier terms can only be committed by committing one
+	//from this term, so start with an empty one.
+	entry := &RaftEntry{Term: n.term, Index: n.lastIndex() + 1}
+	n.log = append(n.log, entry)
+	n.persist(&raftRecord{Op: "entry", Entry: entry})
+	n.termStart = entry.Index
+
+	n.broadcast()
+	n.cond.Broadcast()
+}
+
+func (n *RaftNode) stepDown(term int64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persistState()
+	}
+
+	//What was applied as leader may include records that never commit.
+	if n.state == RaftLeader {
+		logger.Infof("Raft node %s stepping down in term %d.", n.Id, n.term)
+		n.rebuild = true
+		n.leader = ""
+	}
+
+	n.state = RaftFollower
+	n.heard = time.Now()
+	n.cond.Broadcast()
+}
+
+func (n *RaftNode) broadcast() {
+	n.lastBeat = time.Now()
+	for id := range n.peers {
+		if !n.sending[id] {
+			n.sending[id] = true
+			go n.sendAppend(id)
+		}
+	}
+	n.advanceCommit()
+}
+
+func (n *RaftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commit && n.entry(index).Term == n.term; index-- {
+		count := 1
+		for id := range n.peers {
+			if n.match[id] >= index {
+				count++
+			}
+		}
+		if count*2 > len(n.peers)+1 {
+			n.commit = index
+			n.cond.Broadcast()
+			return
+		}
+	}
+}
+
+// quorumTime is the latest time a majority of the cluster, counting this
+// node, has been confirmed to still follow it.
+func (n *RaftNode) quorumTime() time.Time {
+	times := []time.Time{time.Now()}
+	for id := range n.peers {
+		times = append(times, n.acked[id])
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+	return times[len(times)/2]
+}
+
+func (n *RaftNode) sendAppend(id string) {
+	n.Lock()
+	if n.state != RaftLeader {
+		n.sending[id] = false
+		n.Unlock()
+		return
+	}
+
+	prev := n.next[id] - 1
+	if prev < n.base {
+		n.sendSnapshot(id)
+		return
+	}
+	last := n.lastIndex()
+	if last > prev+raftBatch {
+		last = prev + raftBatch
+	}
+
+	term := n.term
+	req := &AppendRequest{
+		Term:      term,
+		Leader:    n.Id,
+		PrevIndex: prev,
+		PrevTerm:  n.entry(prev).Term,
+		Entries:   append([]*RaftEntry{}, n.log[prev+1-n.base:last+1-n.base]...),
+		Commit:    n.commit,
+	}
+	sent := time.Now()
+	n.Unlock()
+
+	var resp AppendResponse
+	err := n.call(n.peers[id]+"/raft/append", req, &resp)
+
+	n.Lock()
+	defer n.Unlock()
+	n.sending[id] = false
+
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+	if n.state != RaftLeader || n.term != term {
+		return
+	}
+
+	if resp.Success {
+		n.match[id] = last
+		n.next[id] = last + 1
+		n.acked[id] = sent
+		n.advanceCommit()
+		n.cond.Broadcast()
+	} else {
+		next := n.next[id] - 1
+		if resp.LastIndex+1 < next {
+			next = resp.LastIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.next[id] = next
+	}
+
+	//Keep going while the peer is behind.
+	if n.next[id] <= n.lastIndex() {
+		n.sending[id] = true
+		go n.sendAppend(id)
+	}
+}
+
+// sendSnapshot sends a peer the snapshot in place of the entries it needs
+// that are no longer in the log. Expects the node lock to be held, and
+// releases it.
+func (n *RaftNode) sendSnapshot(id string) {
+	encoded, err := n.readSnapshot()
+	if err != nil {
+		n.sending[id] = false
+		n.Unlock()
+		logger.Error(err)
+		return
+	}
+
+	term := n.term
+	req := &SnapshotRequest{
+		Term:      term,
+		Leader:    n.Id,
+		LastIndex: n.base,
+		LastTerm:  n.log[0].Term,
+		Data:      encoded,
+	}
+	sent := time.Now()
+	n.Unlock()
+
+	logger.Infof("Raft node %s sending snapshot at %d to %s.", n.Id, req.LastIndex, id)
+
+	var resp SnapshotResponse
+	client := &http.Client{Timeout: raftSnapshotTimeout}
+	err = n.post(client, n.peers[id]+"/raft/snapshot", req, &resp)
+
+	n.Lock()
+	defer n.Unlock()
+	n.sending[id] = false
+
+	if err != nil {
+		logger.Warnf("Unable to send raft snapshot to %s: %s", id, err)
+		return
+	}
+	if resp.Term > n.term {
+		n.stepDown(resp.Term)
+		return
+	}
+	if n.state != RaftLeader || n.term != term || !resp.Success {
+		return
+	}
+
+	if n.match[id] < req.LastIndex {
+		n.match[id] = req.LastIndex
+	}
+	n.next[id] = n.match[id] + 1
+	n.acked[id] = sent
+	n.advanceCommit()
+	n.cond.Broadcast()
+
+	if n.next[id] <= n.lastIndex() {
+		n.sending[id] = true
+		go n.sendAppend(id)
+	}
+}
+
+func (n *RaftNode) call(url string, req, resp interface{}) error {
+	return n.post(n.client, url, req, resp)
+}
+
+func (n *RaftNode) post(client *http.Client, url string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("Raft request to %s failed: %s", url, r.Status)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func (n *RaftNode) HandleVote(req *VoteRequest) *VoteResponse {
+	n.Lock()
+	defer n.Unlock()
+
+	if req.Term > n.term {
+		n.stepDown(req.Term)
+	}
+
+	resp := &VoteResponse{Term: n.term}
+
+	last := n.lastIndex()
+	lastTerm := n.entry(last).Term
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= last)
+
+	if req.Term == n.term && (n.votedFor == "" || n.votedFor == req.Candidate) && upToDate {
+		n.votedFor = req.Candidate
+		n.persistState()
+		n.heard = time.Now()
+		resp.Granted = true
+	}
+
+	return resp
+}
+
+func (n *RaftNode) HandleAppend(req *AppendRequest) *AppendResponse {
+	n.Lock()
+	defer n.Unlock()
+
+	resp := &AppendResponse{Term: n.term, LastIndex: n.lastIndex()}
+	if req.Term < n.term {
+		return resp
+	}
+
+	if req.Term > n.term || n.state != RaftFollower {
+		n.stepDown(req.Term)
+	}
+	n.leader = req.Leader
+	n.heard = time.Now()
+	resp.Term = n.term
+
+	if req.PrevIndex > n.lastIndex() {
+		return resp
+	}
+	//Everything up to base is committed, so it can only match.
+	if req.PrevIndex >= n.base && n.entry(req.PrevIndex).Term != req.PrevTerm {
+		resp.LastIndex = req.PrevIndex - 1
+		return resp
+	}
+
+	recs := []*raftRecord{}
+	for _, e := range req.Entries {
+		if e.Index <= n.base {
+			continue
+		}
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			//A conflicting entry, and everything after it, never committed.
+			n.log = n.log[:e.Index-n.base]
+			recs = append(recs, &raftRecord{Op: "truncate", Index: e.Index})
+			if e.Index <= n.applied {
+				n.rebuild = true
+			}
+		}
+		n.log = append(n.log, e)
+		recs = append(recs, &raftRecord{Op: "entry", Entry: e})
+	}
+	n.persist(recs...)
+
+	if req.Commit > n.commit {
+		n.commit = req.Commit
+		if last := req.PrevIndex + int64(len(req.Entries)); last < n.commit {
+			n.commit = last
+		}
+		n.cond.Broadcast()
+	}
+
+	resp.Success = true
+	resp.LastIndex = n.lastIndex()
+	return resp
+}
+
+func (n *RaftNode) HandleSnapshot(req *SnapshotRequest) *SnapshotResponse {
+	n.Lock()
+	defer n.Unlock()
+
+	resp := &SnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+
+	if req.Term > n.term || n.state != RaftFollower {
+		n.stepDown(req.Term)
+	}
+	n.leader = req.Leader
+	n.heard = time.Now()
+	resp.Term = n.term
+
+	//Everything it covers is already committed here.
+	if req.LastIndex <= n.commit {
+		resp.Success = true
+		return resp
+	}
+
+	snap, err := DecodeSnapshot(bytes.NewReader(req.Data), "raft snapshot")
+	if err == nil && snap.Index != req.LastIndex {
+		err = fmt.Errorf("Raft snapshot is at %d, not %d.", snap.Index, req.LastIndex)
+	}
+	if err == nil {
+		err = n.saveSnapshot(req.Data)
+	}
+	if err != nil {
+		logger.Errorf("Unable to install raft snapshot from %s: %s", req.Leader, err)
+		return resp
+	}
+
+	logger.Infof("Raft node %s installing snapshot at %d from %s.", n.Id, req.LastIndex, req.Leader)
+
+	//Entries after the snapshot are only kept if the log agrees with it.
+	log := []*RaftEntry{{Term: req.LastTerm, Index: req.LastIndex}}
+	if req.LastIndex <= n.lastIndex() && n.entry(req.LastIndex).Term == req.LastTerm {
+		log = append(log, n.log[req.LastIndex-n.base+1:]...)
+	}
+	n.log, n.base = log, req.LastIndex
+	n.commit = req.LastIndex
+	n.rebuild = true
+	if err := n.rewrite(); err != nil {
+		logger.Error(err)
+	}
+	n.cond.Broadcast()
+
+	resp.Success = true
+	return resp
+}
+
+// SnapshotPoint returns the index and term of the last log entry the
+// applied data reflects, to take a snapshot of it at. It must be called
+// with every change held off, and returns zero when the data can't be
+// trusted to match the log, such as while it is being rebuilt.
+func (n *RaftNode) SnapshotPoint() (int64, int64) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.rebuild {
+		return 0, 0
+	}
+
+	//A leader has also applied everything it put in the log itself.
+	index := n.applied
+	if n.state == RaftLeader {
+		if n.applied < n.termStart-1 {
+			return 0, 0
+		}
+		index = n.lastIndex()
+	}
+	return index, n.entry(index).Term
+}
+
+// Compact replaces the log up to index with a snapshot of the states,
+// which must be what applying the log up to the entry at index and term
+// gives. It waits until the node has applied that far, and gives up if
+// the entry was replaced in the meantime.
+func (n *RaftNode) Compact(index, term int64, states []*EntryState, timeout time.Duration) error {
+	var buf bytes.Buffer
+	if err := EncodeSnapshot(&buf, &Snapshot{Time: time.Now(), Index: index, Term: term, Entries: states}); err != nil {
+		return err
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		n.Lock()
+		n.cond.Broadcast()
+		n.Unlock()
+	})
+	defer timer.Stop()
+
+	for n.applied < index {
+		if n.stopped {
+			return fmt.Errorf("Raft node stopped before the snapshot at %d committed.", index)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for the snapshot at %d to commit.", index)
+		}
+		n.cond.Wait()
+	}
+
+	if index <= n.base {
+		return nil
+	}
+	if n.entry(index).Term != term {
+		return fmt.Errorf("Raft log was replaced before the snapshot at %d committed.", index)
+	}
+
+	if err := n.saveSnapshot(buf.Bytes()); err != nil {
+		return err
+	}
+	n.log = append([]*RaftEntry{{Term: term, Index: index}}, n.log[index-n.base+1:]...)
+	n.base = index
+
+	logger.Infof("Raft node %s compacted its log up to %d.", n.Id, index)
+	return n.rewrite()
+}
+
+// LogSize returns how many entries the log holds after the snapshot.
+func (n *RaftNode) LogSize() int {
+	n.Lock()
+	defer n.Unlock()
+	return len(n.log) - 1
+}
+
+// Propose adds a record to the log. Only the leader takes proposals, and
+// the record is applied by every other node once it commits.
+func (n *RaftNode) Propose(rec *WALRecord) (int64, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.state != RaftLeader {
+		return 0, fmt.Errorf("Cannot propose record for '%s', not the leader.", rec.Key)
+	}
+
+	entry := &RaftEntry{Term: n.term, Index: n.lastIndex() + 1, Record: rec}
+	n.log = append(n.log, entry)
+	n.persist(&raftRecord{Op: "entry", Entry: entry})
+
+	select {
+	case n.kick <- struct{}{}:
+	default:
+	}
+
+	return entry.Index, nil
+}
+
+// wait blocks until done returns true, the node stops leading, or the
+// timeout passes. Expects the node lock to be held.
+func (n *RaftNode) wait(timeout time.Duration, done func() bool) error {
+	term := n.term
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		n.Lock()
+		n.cond.Broadcast()
+		n.Unlock()
+	})
+	defer timer.Stop()
+
+	for {
+		if n.stopped || n.state != RaftLeader || n.term != term {
+			return fmt.Errorf("Lost leadership of the cluster.")
+		}
+		if done() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for the cluster.")
+		}
+		n.cond.Wait()
+	}
+}
+
+// Ready waits until the leader has applied everything committed before
+// its term, so what it serves is up to date.
+func (n *RaftNode) Ready(timeout time.Duration) error {
+	n.Lock()
+	defer n.Unlock()
+
+	return n.wait(timeout, func() bool {
+		return !n.rebuild && n.applied >= n.termStart
+	})
+}
+
+// Barrier waits until everything in the log so far has committed, and a
+// majority has confirmed this node still leads since start. A response
+// held back until then can't reflect anything the cluster might lose, or
+// miss anything it committed elsewhere.
+func (n *RaftNode) Barrier(start time.Time, timeout time.Duration) error {
+	n.Lock()
+	defer n.Unlock()
+
+	index := n.lastIndex()
+	return n.wait(timeout, func() bool {
+		return n.commit >= index && !n.quorumTime().Before(start)
+	})
+}
+
+func (n *RaftNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp interface{}
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/raft/vote"):
+		req := &VoteRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp = n.HandleVote(req)
+
+	case strings.HasSuffix(r.URL.Path, "/raft/append"):
+		req := &AppendRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp = n.HandleAppend(req)
+
+	case strings.HasSuffix(r.URL.Path, "/raft/snapshot"):
+		req := &SnapshotRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp = n.HandleSnapshot(req)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
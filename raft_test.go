@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testRaftNode struct {
+	*RaftNode
+	server *httptest.Server
+	stop   chan struct{}
+
+	mu      sync.Mutex
+	applied []string
+	down    bool
+}
+
+// setDown cuts the node off from its peers, or connects it again.
+func (n *testRaftNode) setDown(down bool) {
+	n.mu.Lock()
+	n.down = down
+	n.mu.Unlock()
+}
+
+func (n *testRaftNode) Applied() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string{}, n.applied...)
+}
+
+// startTestCluster runs size nodes in-process, talking over loopback.
+func startTestCluster(t *testing.T, size int) []*testRaftNode {
+	nodes := make([]*testRaftNode, size)
+	addrs := make(map[string]string)
+
+	for i := range nodes {
+		n := &testRaftNode{stop: make(chan struct{})}
+		n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n.mu.Lock()
+			down := n.down
+			n.mu.Unlock()
+			if down {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			n.RaftNode.ServeHTTP(w, r)
+		}))
+		nodes[i] = n
+		addrs[fmt.Sprint(i)] = n.server.URL
+	}
+
+	for i, n := range nodes {
+		n := n
+		peers := make(map[string]string)
+		for id, addr := range addrs {
+			if id != fmt.Sprint(i) {
+				peers[id] = addr
+			}
+		}
+
+		node, err := NewRaftNode(fmt.Sprint(i), peers, "", func(rec *WALRecord) {
+			n.mu.Lock()
+			n.applied = append(n.applied, rec.Key)
+			n.mu.Unlock()
+		}, func(states []*EntryState) {
+			n.mu.Lock()
+			n.applied = nil
+			for _, s := range states {
+				n.applied = append(n.applied, s.Key)
+			}
+			n.mu.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.RaftNode = node
+	}
+
+	for _, n := range nodes {
+		go n.Run(n.stop)
+	}
+	return nodes
+}
+
+func stopTestNode(n *testRaftNode) {
+	n.server.CloseClientConnections()
+	n.server.Close()
+	close(n.stop)
+}
+
+// waitForLeader returns the only leader among the running nodes.
+func waitForLeader(t *testing.T, nodes []*testRaftNode) *testRaftNode {
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		var leader *testRaftNode
+		leaders := 0
+		for _, n := range nodes {
+			if state, _, _ := n.Status(); state == RaftLeader {
+				leader = n
+				leaders++
+			}
+		}
+		if leaders == 1 {
+			return leader
+		}
+		time.Sleep(raftTick)
+	}
+	t.Fatal("No leader was elected.")
+	return nil
+}
+
+func waitForApplied(t *testing.T, nodes []*testRaftNode, expected string) {
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		caught := 0
+		for _, n := range nodes {
+			if strings.Join(n.Applied(), ",") == expected {
+				caught++
+			}
+		}
+		if caught == len(nodes) {
+			return
+		}
+		time.Sleep(raftTick)
+	}
+	for _, n := range nodes {
+		t.Errorf("Node %s applied: %v", n.Id, n.Applied())
+	}
+	t.Fatalf("Every node should have applied: %s", expected)
+}
+
+func waitForSelfElection(t *testing.T, node *RaftNode) {
+	deadline := time.Now().Add(time.Second * 5)
+	for state, _, _ := node.Status(); state != RaftLeader; state, _, _ = node.Status() {
+		if time.Now().After(deadline) {
+			t.Fatal("A single node should elect itself.")
+		}
+		time.Sleep(raftTick)
+	}
+}
+
+func TestRaftReplication(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	defer func() {
+		for _, n := range nodes {
+			select {
+			case <-n.stop:
+			default:
+				stopTestNode(n)
+			}
+		}
+	}()
+
+	leader := waitForLeader(t, nodes)
+
+	start := time.Now()
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := leader.Propose(&WALRecord{Op: "put", Key: key, Entry: &EntryState{Key: key}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := leader.Barrier(start, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+
+	//The leader already has its own proposals.
+	followers := []*testRaftNode{}
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+			if _, err := n.Propose(&WALRecord{Op: "put", Key: "x"}); err == nil {
+				t.Error("Followers should not take proposals.")
+			}
+		}
+	}
+	waitForApplied(t, followers, "a,b,c")
+
+	_, term, _ := leader.Status()
+	stopTestNode(leader)
+
+	next := waitForLeader(t, followers)
+	if _, newTerm, _ := next.Status(); newTerm <= term {
+		t.Error("A new leader should be elected in a later term.")
+	}
+
+	start = time.Now()
+	if _, err := next.Propose(&WALRecord{Op: "delete", Key: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := next.Barrier(start, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range followers {
+		if n != next {
+			waitForApplied(t, []*testRaftNode{n}, "a,b,c,d")
+		}
+	}
+}
+
+func TestRaftPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "httpdb.raft")
+
+	noop := func(*WALRecord) {}
+
+	node, err := NewRaftNode("a", nil, path, noop, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go node.Run(stop)
+
+	waitForSelfElection(t, node)
+
+	start := time.Now()
+	node.Propose(&WALRecord{Op: "put", Key: "a", Entry: &EntryState{Key: "a"}})
+	if err := node.Barrier(start, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	_, term, _ := node.Status()
+	close(stop)
+
+	restored, err := NewRaftNode("a", nil, path, noop, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.term != term || restored.votedFor != "a" || restored.lastIndex() != 2 || restored.log[2].Record.Key != "a" {
+		t.Error("Term, vote and log should survive a restart.")
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	defer func() {
+		for _, n := range nodes {
+			stopTestNode(n)
+		}
+	}()
+
+	leader := waitForLeader(t, nodes)
+
+	//Cut a follower off, without it calling elections of its own.
+	var lagging *testRaftNode
+	for _, n := range nodes {
+		if n != leader {
+			lagging = n
+			break
+		}
+	}
+	lagging.Lock()
+	lagging.timeout = time.Hour
+	lagging.Unlock()
+	lagging.setDown(true)
+
+	start := time.Now()
+	states := []*EntryState{}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := leader.Propose(&WALRecord{Op: "put", Key: key, Entry: &EntryState{Key: key}}); err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, &EntryState{Key: key})
+	}
+	if err := leader.Barrier(start, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+
+	index, term := leader.SnapshotPoint()
+	if err := leader.Compact(index, term, states, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	if size := leader.LogSize(); size != 0 {
+		t.Errorf("The log should be compacted behind the snapshot. Entries left: %d", size)
+	}
+
+	//The entries it missed are gone, so it has to be sent the snapshot.
+	lagging.setDown(false)
+	start = time.Now()
+	if _, err := leader.Propose(&WALRecord{Op: "put", Key: "d", Entry: &EntryState{Key: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Barrier(start, time.Second*5); err != nil {
+		t.Fatal(err)
+	}
+	waitForApplied(t, []*testRaftNode{lagging}, "a,b,c,d")
+
+	lagging.Lock()
+	base := lagging.base
+	lagging.Unlock()
+	if base != index {
+		t.Errorf("The follower's log should start from the snapshot at %d. Started from: %d", index, base)
+	}
+}
+
+func TestRaftCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "httpdb.raft")
+
+	noop := func(*WALRecord) {}
+
+	node, err := NewRaftNode("a", nil, path, noop, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go node.Run(stop)
+
+	waitForSelfElection(t, node)
+
+	start := time.Now()
+	node.Propose(&WALRecord{Op: "put", Key: "a", Entry: &EntryState{Key: "a"}})
+	if err := node.Barrier(start, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	index, term := node.SnapshotPoint()
+	if err := node.Compact(index, term, []*EntryState{{Key: "a"}}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	start = time.Now()
+	node.Propose(&WALRecord{Op: "put", Key: "b", Entry: &EntryState{Key: "b"}})
+	if err := node.Barrier(start, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+
+	reset := []string{}
+	restored, err := NewRaftNode("a", nil, path, noop, func(states []*EntryState) {
+		for _, s := range states {
+			reset = append(reset, s.Key)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.base != index || restored.lastIndex() != index+1 || restored.entry(index+1).Record.Key != "b" {
+		t.Error("The log should start from the snapshot after a restart.")
+	}
+
+	restored.applyCommitted()
+	if strings.Join(reset, ",") != "a" {
+		t.Errorf("The snapshot should be loaded to rebuild from. Loaded: %v", reset)
+	}
+}
+
+func TestClusterRoute(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	node, err := NewRaftNode("a", map[string]string{"b": "http://127.0.0.1:1"}, "", clusterApply, clusterReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster = node
+	defer func() { cluster = nil }()
+
+	//Without a leader there is nowhere to send requests.
+	req, err := http.NewRequest("PUT", fmt.Sprintf(putValUrl, "a"), strings.NewReader("one"))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusServiceUnavailable, w.Code)
+
+	//Make this node the leader of a cluster of one.
+	single, err := NewRaftNode("a", nil, "", clusterApply, clusterReset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster = single
+	stop := make(chan struct{})
+	defer close(stop)
+	go single.Run(stop)
+
+	waitForSelfElection(t, single)
+
+	req, err = http.NewRequest("PUT", fmt.Sprintf(putValUrl, "a"), strings.NewReader("one"))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	var reply map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Errorf("Unmarshal error: %s", err)
+	}
+	lockId := reply["lock_id"]
+
+	single.Lock()
+	logged := []string{}
+	for _, e := range single.log {
+		if e.Record != nil {
+			logged = append(logged, e.Record.Op+":"+e.Record.Entry.LockId)
+		}
+	}
+	commit := single.commit
+	last := single.lastIndex()
+	single.Unlock()
+
+	if commit != last {
+		t.Error("The response should only be sent once everything is committed.")
+	}
+
+	found := false
+	for _, l := range logged {
+		if l == "put:"+lockId {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("The lock grant should be in the cluster log. Logged: %v", logged)
+	}
+}
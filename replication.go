@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+const (
+	epochHeader    = "X-Httpdb-Epoch"
+	sequenceHeader = "X-Httpdb-Sequence"
+
+	//How often an idle replication stream sends a blank line, so both
+	//ends notice a dead connection.
+	streamHeartbeat = time.Second * 5
+)
+
+var replica = &Replica{}
+
+// Replica tracks the leader this node follows, if any. While following,
+// the node applies the leader's changes as they stream in, serves reads,
+// and redirects everything else to the leader until it is promoted.
+type Replica struct {
+	sync.Mutex
+	leader string
+	cancel context.CancelFunc
+
+	//Only touched by the follower goroutine.
+	epoch string
+	seq   int64
+}
+
+func (f *Replica) Leader() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.leader
+}
+
+// Promote stops following the leader, returning false if there wasn't one.
+func (f *Replica) Promote() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.leader == "" {
+		return false
+	}
+
+	f.leader = ""
+	if f.cancel != nil {
+		f.cancel()
+	}
+	return true
+}
+
+// resync replaces the whole DataStore with a copy from the leader and
+// picks up the change stream from the point it was taken.
+func (f *Replica) resync(ctx context.Context, leader string) error {
+	resp, err := replicationGet(ctx, leader+"/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to fetch snapshot from leader: %s", resp.Status)
+	}
+
+	seq, err := strconv.ParseInt(resp.Header.Get(sequenceHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Leader sent an invalid sequence number: %s", err)
+	}
+
+	snap, err := DecodeSnapshot(resp.Body, "leader snapshot")
+	if err != nil {
+		return err
+	}
+
+	data.Restore(snap.Entries, true)
+	f.epoch = resp.Header.Get(epochHeader)
+	f.seq = seq
+
+	logger.Infof("Resynced %d entries from leader at sequence %d.", len(snap.Entries), seq)
+	return nil
+}
+
+// follow applies changes from the leader's stream until it ends.
+func (f *Replica) follow(ctx context.Context, leader string) error {
+	if f.epoch == "" {
+		if err := f.resync(ctx, leader); err != nil {
+			return err
+		}
+	}
+
+	url := fmt.Sprintf("%s/replication/stream?since=%d&epoch=%s", leader, f.seq, f.epoch)
+	resp, err := replicationGet(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		f.epoch = ""
+		return fmt.Errorf("Leader no longer has the changes since %d, resyncing.", f.seq)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unable to stream changes from leader: %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var rec WALRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("Unable to parse change from leader: %s", err)
+		}
+
+		//The leader's revision, recording it here gives it one of ours.
+		seq := rec.Rev
+		data.Apply(&rec)
+		f.seq = seq
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("Leader closed the replication stream.")
+}
+
+func replicationGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+// Apply makes a change streamed from the leader, and records it here too
+// so this node's own log and followers stay in step.
+func (d *DataStore) Apply(rec *WALRecord) {
+	d.apply(rec)
+	record(rec)
+}
+
+func (d *DataStore) apply(rec *WALRecord) {
+	d.Lock()
+	defer d.Unlock()
+
+	switch rec.Op {
+	case "put":
+		d.load(rec.Entry)
+	case "delete":
+		d.unload(rec.Key)
+	}
+}
+
+// acceptsWrites is whether this node is the one making changes: it isn't
+// following a leader, and it leads its cluster if it is in one.
+func acceptsWrites() bool {
+	if replica.Leader() != "" {
+		return false
+	}
+	if cluster != nil {
+		state, _, _ := cluster.Status()
+		return state == RaftLeader
+	}
+	return true
+}
+
+// followerRedirect sends requests that could change anything to the
+// leader while this node is following one, sessions included. Only
+// promotion and the node's own webhooks are served, and batch gets since
+// they only read.
+func followerRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leader := replica.Leader()
+		readOnly := (r.Method == "GET" || r.Method == "HEAD") && r.URL.Path != "/sessions"
+		readOnly = readOnly || r.URL.Path == "/batch/get"
+		if leader == "" || readOnly || r.URL.Path == "/admin/promote" || nodeLocal(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logger.Infof("Redirecting %s request for %s to leader: %s", r.Method, r.URL.Path, leader)
+		http.Redirect(w, r, leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+}
+
+func replicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /replication/snapshot, request id: %s", random.String(5))
+
+	//The copy is taken a page at a time while writes carry on, so the
+	//follower picks up the stream from before it started, and replays
+	//whatever changed meanwhile over the top.
+	seq := changes.Seq()
+	snap := &Snapshot{Time: time.Now(), Rev: seq}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(epochHeader, changes.Epoch)
+	w.Header().Set(sequenceHeader, strconv.FormatInt(seq, 10))
+	w.WriteHeader(http.StatusOK)
+
+	s, err := NewSnapshotWriter(w, snap)
+	if err == nil {
+		err = data.Backup(Config.App.WALLocks, s.Write)
+	}
+	if err == nil {
+		err = s.Close()
+	}
+	if err != nil {
+		logger.Errorf("Error writing replication snapshot: %s", err)
+		return
+	}
+	logger.Infof("Handled successful replication snapshot of %d entries at sequence %d.", s.Count(), seq)
+}
+
+func replicationStream(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /replication/stream, request id: %s", random.String(5))
+
+	query := r.URL.Query()
+	seq, err := strconv.ParseInt(query.Get("since"), 10, 64)
+	if err != nil {
+		logger.Infof("Invalid request, bad sequence number: %s", query.Get("since"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("epoch") != changes.Epoch {
+		logger.Infof("Follower is from another epoch, it needs to resync: %s", query.Get("epoch"))
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	pending, wake, ok := changes.Since(seq)
+	if !ok {
+		logger.Infof("Changes since %d are gone, follower needs to resync.", seq)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(epochHeader, changes.Epoch)
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	enc := json.NewEncoder(w)
+	for {
+		for _, change := range pending {
+			if !Config.App.WALLocks {
+				c := *change
+				c.Entry = withoutLock(c.Entry)
+				change = &c
+			}
+			if err := enc.Encode(change); err != nil {
+				return
+			}
+			seq = change.Rev
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return
+			}
+			if canFlush {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		}
+
+		//A follower that falls too far behind is cut off and resyncs.
+		if pending, wake, ok = changes.Since(seq); !ok {
+			logger.Infof("Follower fell behind at sequence %d, closing stream.", seq)
+			return
+		}
+	}
+}
+
+func promote(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /admin/promote, request id: %s", random.String(5))
+
+	if !replica.Promote() {
+		logger.Info("Invalid request, not following a leader.")
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Info("Promoted to leader, no longer following.")
+}
+
+func startFollower(stop chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replica.Lock()
+	leader := replica.leader
+	replica.cancel = cancel
+	replica.Unlock()
+
+	if leader == "" {
+		return
+	}
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	logger.Infof("Started Follower Gouroutine, following: %s", leader)
+	for {
+		err := replica.follow(ctx, leader)
+		if ctx.Err() != nil {
+			logger.Info("Stopped Follower Goroutine.")
+			return
+		}
+		logger.Warnf("Replication from %s interrupted: %s", leader, err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			logger.Info("Stopped Follower Goroutine.")
+			return
+		}
+	}
+}
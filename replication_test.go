@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChangeLog(t *testing.T) {
+	log := NewChangeLog(3)
+	for i := 0; i < 5; i++ {
+		log.Append(&WALRecord{Op: "put", Key: fmt.Sprint(i), Entry: &EntryState{Key: fmt.Sprint(i)}})
+	}
+
+	if pending, _, ok := log.Since(5); !ok || len(pending) != 0 {
+		t.Error("A caught up reader should get no changes.")
+	}
+
+	pending, _, ok := log.Since(2)
+	if !ok || len(pending) != 3 || pending[0].Rev != 3 || pending[2].Key != "4" {
+		t.Errorf("Should get the three kept changes. Received: %v", pending)
+	}
+
+	if _, _, ok := log.Since(1); ok {
+		t.Error("Changes that were dropped should need a resync.")
+	}
+
+	if _, _, ok := log.Since(6); ok {
+		t.Error("Changes from the future should need a resync.")
+	}
+
+	_, wake, _ := log.Since(5)
+	log.Append(&WALRecord{Op: "delete", Key: "0"})
+	select {
+	case <-wake:
+	default:
+		t.Error("Readers should be woken by a new change.")
+	}
+}
+
+func TestFollower(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	changes = NewChangeLog(100)
+	defer func() { changes = nil }()
+
+	data.NewEntry("stale")
+
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/replication/snapshot":
+			w.Header().Set(epochHeader, "epoch")
+			w.Header().Set(sequenceHeader, "4")
+			EncodeSnapshot(w, &Snapshot{Entries: []*EntryState{{Key: "a", Value: "one", Revision: 1}}})
+		case "/replication/stream":
+			if r.URL.RawQuery != "since=4&epoch=epoch" {
+				w.WriteHeader(http.StatusGone)
+				return
+			}
+			fmt.Fprintln(w, `{"rev":5,"op":"put","key":"b","entry":{"key":"b","value":"two","revision":1}}`)
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, `{"rev":6,"op":"delete","key":"a"}`)
+		}
+	}))
+	defer leader.Close()
+
+	before := changes.Seq()
+
+	err := replica.follow(context.Background(), leader.URL)
+	if err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("Should follow until the stream is closed. Received: %v", err)
+	}
+
+	if replica.seq != 6 {
+		t.Errorf("Should have applied through sequence 6. Applied: %d", replica.seq)
+	}
+
+	if data.EntryExists("stale") || data.EntryExists("a") {
+		t.Error("Resync should replace everything, and deletes should be applied.")
+	}
+
+	if b, err := data.GetEntry("b"); err != nil || b.GetValue() != "two" {
+		t.Error("Streamed puts should be applied.")
+	}
+
+	//The resync deletes one entry and restores another, then two stream in.
+	if changes.Seq()-before != 4 {
+		t.Errorf("Applied changes should be recorded for this node's followers. Recorded: %d", changes.Seq()-before)
+	}
+
+	replica.leader = leader.URL
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf(putValUrl+"?x=1", "c"), strings.NewReader("three"))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusTemporaryRedirect, w.Code)
+
+	if w.Header().Get("Location") != leader.URL+"/values/c?x=1" {
+		t.Errorf("Should redirect to the same path on the leader. Received: %s", w.Header().Get("Location"))
+	}
+
+	req, err = http.NewRequest("GET", fmt.Sprintf(putValUrl, "b"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	req, err = http.NewRequest("POST", "/admin/promote", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	if replica.Leader() != "" {
+		t.Error("Promotion should stop following the leader.")
+	}
+
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusConflict, w.Code)
+}
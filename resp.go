@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+// respMaxArgs, respMaxBulk and respMaxInline bound what a client can make
+// the server allocate for a single command. Room for more than
+// respPreallocArgs arguments is only made as they arrive.
+const (
+	respMaxArgs      = 1024 * 1024
+	respMaxBulk      = wsMaxMessage
+	respMaxInline    = 64 * 1024
+	respPreallocArgs = 1024
+)
+
+// The replies a command can have, beyond integers and arrays. A nil
+// *string is the null bulk string.
+type (
+	respSimple string
+	respError  string
+)
+
+const respOK = respSimple("OK")
+
+// respCommand is one of the Redis commands served. Min and max count the
+// arguments after the command name, with a max of -1 for no limit.
+type respCommand struct {
+	min, max int
+	write    bool
+	run      func(c *respConn, args []string) interface{}
+}
+
+var respCommands = map[string]*respCommand{
+	"PING":    {min: 0, max: 1, run: respPing},
+	"GET":     {min: 1, max: 1, run: respGet},
+	"SET":     {min: 2, max: 5, write: true, run: respSet},
+	"DEL":     {min: 1, max: -1, write: true, run: respDel},
+	"EXISTS":  {min: 1, max: -1, run: respExists},
+	"EXPIRE":  {min: 2, max: 2, write: true, run: respExpire(time.Second)},
+	"PEXPIRE": {min: 2, max: 2, write: true, run: respExpire(time.Millisecond)},
+	"INCR":    {min: 1, max: 1, write: true, run: respIncr},
+	"KEYS":    {min: 1, max: 1, run: respKeys},
+	"SCAN":    {min: 1, max: 5, run: respScan},
+}
+
+// respKey checks the key belongs on this node.
+func respKey(key string) error {
+	if shards != nil {
+		ring, _ := shards.Rings()
+		if owner := ring.Owner(key); owner != shards.Id {
+			return fmt.Errorf("ERR key belongs to shard %s", owner)
+		}
+	}
+	return nil
+}
+
+// respString returns the entry for a key as long as it holds a string,
+// creating it if create is set.
+func respString(key string, create bool) (*Entry, interface{}) {
+	if err := respKey(key); err != nil {
+		return nil, respError(err.Error())
+	}
+
+	entry, err := data.GetEntry(key)
+	if err != nil && create {
+		entry = &Entry{Key: key}
+		if err = data.AddEntry(entry); err != nil {
+			//Someone else beat us to it.
+			entry, err = data.GetEntry(key)
+		}
+	}
+	if err != nil {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+func respPing(c *respConn, args []string) interface{} {
+	if len(args) > 0 {
+		return &args[0]
+	}
+	return respSimple("PONG")
+}
+
+func respGet(c *respConn, args []string) interface{} {
+	entry, reply := respString(args[0], false)
+	if entry == nil {
+		if reply == nil {
+			return (*string)(nil)
+		}
+		return reply
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		return respError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	value := entry.GetValue()
+	return &value
+}
+
+// respSet is SET key value [NX|XX] [EX seconds|PX milliseconds]. With NX
+// and an expiry it is a reservation: the key is created with the value as
+// its token and locked with a new lock id, which the connection keeps
+// until it deletes the key or the expiry runs out. Entries can't
+// otherwise be given an expiry here, so an expiry needs NX.
+func respSet(c *respConn, args []string) interface{} {
+	key, value := args[0], args[1]
+	var nx, xx bool
+	var ttl time.Duration
+
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 == len(args) {
+				return respError("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return respError("ERR invalid expire time in 'set' command")
+			}
+			ttl = time.Duration(n) * time.Millisecond
+			if opt == "EX" {
+				ttl = time.Duration(n) * time.Second
+			}
+			i++
+		default:
+			return respError("ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return respError("ERR syntax error")
+	}
+	if ttl > 0 && !nx {
+		return respError("ERR expiry is only supported along with NX, to reserve a key")
+	}
+	if err := respKey(key); err != nil {
+		return respError(err.Error())
+	}
+
+	if nx {
+		entry := &Entry{Key: key}
+		if err := data.AddEntry(entry); err != nil {
+			return (*string)(nil)
+		}
+
+		entry.Lock()
+		defer entry.Unlock()
+
+		if ttl > 0 {
+			lockId := newLockId()
+			if !entry.SetLockId(lockId) {
+				return (*string)(nil)
+			}
+			entry.SetExpiry(time.Now().Add(ttl))
+			c.leases[key] = lockId
+		}
+		entry.SetValue(value)
+		return respOK
+	}
+
+	entry, reply := respString(key, !xx)
+	if entry == nil {
+		if reply == nil {
+			return (*string)(nil)
+		}
+		return reply
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		return respError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	if entry.IsLocked() {
+		return respError("LOCKED key is reserved")
+	}
+
+	entry.SetValue(value)
+	return respOK
+}
+
+// respDel deletes the keys that exist and aren't reserved, along with any
+// this connection holds the lease on. Keys reserved by anyone else are
+// skipped, and not counted.
+func respDel(c *respConn, args []string) interface{} {
+	var deleted int64
+	for _, key := range args {
+		if err := respKey(key); err != nil {
+			return respError(err.Error())
+		}
+
+		lockId := c.leases[key]
+		delete(c.leases, key)
+
+		_, results, err := data.Commit(&Txn{Then: []*TxnOp{{Op: TxnDelete, Key: key, LockId: lockId}}})
+		if err == nil && results[0].Status == http.StatusNoContent {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func respExists(c *respConn, args []string) interface{} {
+	var count int64
+	for _, key := range args {
+		if err := respKey(key); err != nil {
+			return respError(err.Error())
+		}
+		if data.EntryExists(key) {
+			count++
+		}
+	}
+	return count
+}
+
+// respExpire renews the lease this connection holds on a key reserved
+// with SET NX PX, counting the new expiry in units. For any other key it
+// does nothing and returns 0.
+func respExpire(unit time.Duration) func(c *respConn, args []string) interface{} {
+	return func(c *respConn, args []string) interface{} {
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n <= 0 {
+			return respError("ERR invalid expire time")
+		}
+		if err := respKey(args[0]); err != nil {
+			return respError(err.Error())
+		}
+
+		key := args[0]
+		lockId, held := c.leases[key]
+		if !held {
+			return int64(0)
+		}
+
+		entry, err := data.GetEntry(key)
+		if err != nil {
+			delete(c.leases, key)
+			return int64(0)
+		}
+
+		entry.Lock()
+		defer entry.Unlock()
+
+		//The lease ran out, or was released, since.
+		if !entry.ValidLock(lockId) {
+			delete(c.leases, key)
+			return int64(0)
+		}
+
+		entry.SetExpiry(time.Now().Add(time.Duration(n) * unit))
+		return int64(1)
+	}
+}
+
+func respIncr(c *respConn, args []string) interface{} {
+	entry, reply := respString(args[0], true)
+	if entry == nil {
+		if reply == nil {
+			return respError("ERR no such key")
+		}
+		return reply
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		return respError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	}
+	if entry.IsLocked() {
+		return respError("LOCKED key is reserved")
+	}
+
+	var n int64
+	if value := entry.GetValue(); value != "" {
+		var err error
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return respError("ERR value is not an integer or out of range")
+		}
+	}
+
+	n++
+	entry.SetValue(strconv.FormatInt(n, 10))
+	return n
+}
+
+// globPrefix is the part of a pattern before anything special, which
+// every matching key starts with.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch matches the glob-style patterns Redis does: *, ?, [abc],
+// [^abc], [a-z], and \ to escape.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		case '[':
+			if s == "" {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					matched = matched || (class[i] <= s[0] && s[0] <= class[i+2])
+					i += 2
+				} else {
+					matched = matched || class[i] == s[0]
+				}
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+func respKeys(c *respConn, args []string) interface{} {
+	keys := []string{}
+	for _, key := range data.RangeKeys(PrefixRange(globPrefix(args[0])), 0, 0) {
+		if globMatch(args[0], key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// respScan is SCAN cursor [MATCH pattern] [COUNT count]. The cursor is
+// how many keys have been gone over so far, so keys added or removed in
+// the meantime may be skipped or returned twice.
+func respScan(c *respConn, args []string) interface{} {
+	offset, err := strconv.Atoi(args[0])
+	if err != nil || offset < 0 {
+		return respError("ERR invalid cursor")
+	}
+
+	pattern := "*"
+	count := 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return respError("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return respError("ERR syntax error")
+			}
+		default:
+			return respError("ERR syntax error")
+		}
+	}
+
+	page := data.RangeKeys(&KeyRange{}, offset, count)
+	keys := []string{}
+	for _, key := range page {
+		if globMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	next := "0"
+	if len(page) == count {
+		next = strconv.Itoa(offset + count)
+	}
+	return []interface{}{&next, keys}
+}
+
+// respConn is one client connection. Leases are the lock ids of the keys
+// it reserved with SET NX PX, which only it can delete or renew. They
+// outlive the connection, until they run out.
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	leases map[string]string
+}
+
+// ReadCommand reads a command sent as an array of bulk strings, or
+// typed in inline, one command per line.
+func (c *respConn) ReadCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > respMaxArgs {
+		return nil, fmt.Errorf("Protocol error: invalid multibulk length")
+	}
+
+	//A null array is no command at all, like an empty one.
+	if n <= 0 {
+		return nil, nil
+	}
+
+	prealloc := n
+	if prealloc > respPreallocArgs {
+		prealloc = respPreallocArgs
+	}
+	args := make([]string, 0, prealloc)
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("Protocol error: expected '$', got '%.1s'", line)
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulk {
+			return nil, fmt.Errorf("Protocol error: invalid bulk length")
+		}
+
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, bulk); err != nil {
+			return nil, err
+		}
+		args = append(args, string(bulk[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads up to the next newline, refusing lines longer than
+// respMaxInline rather than buffering whatever the client sends.
+func (c *respConn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > respMaxInline {
+			return "", fmt.Errorf("Protocol error: too big inline request")
+		}
+		line = append(line, chunk...)
+
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (c *respConn) WriteReply(reply interface{}) {
+	switch r := reply.(type) {
+	case respSimple:
+		fmt.Fprintf(c.writer, "+%s\r\n", r)
+	case respError:
+		fmt.Fprintf(c.writer, "-%s\r\n", r)
+	case int64:
+		fmt.Fprintf(c.writer, ":%d\r\n", r)
+	case *string:
+		if r == nil {
+			c.writer.WriteString("$-1\r\n")
+		} else {
+			fmt.Fprintf(c.writer, "$%d\r\n%s\r\n", len(*r), *r)
+		}
+	case []string:
+		fmt.Fprintf(c.writer, "*%d\r\n", len(r))
+		for i := range r {
+			c.WriteReply(&r[i])
+		}
+	case []interface{}:
+		fmt.Fprintf(c.writer, "*%d\r\n", len(r))
+		for _, item := range r {
+			c.WriteReply(item)
+		}
+	}
+}
+
+// respRun runs a command. Like any other request, in a cluster only the
+// leader serves it, and the reply waits until it is committed. Followers
+// of a replication leader only serve reads.
+func respRun(c *respConn, name string, cmd *respCommand, args []string) interface{} {
+	if cmd.write && replica.Leader() != "" {
+		return respError("READONLY You can't write against a read only replica.")
+	}
+
+	if cluster == nil {
+		return cmd.run(c, args)
+	}
+
+	timeout := time.Second * Config.App.TimeOut
+	start := time.Now()
+
+	if state, _, leader := cluster.Status(); state != RaftLeader {
+		return respError("ERR not the cluster leader, the leader is " + leader)
+	}
+	if err := cluster.Ready(timeout); err != nil {
+		return respError("ERR " + err.Error())
+	}
+
+	reply := cmd.run(c, args)
+
+	if err := cluster.Barrier(start, timeout); err != nil {
+		logger.Warnf("Dropping reply to %s command: %s", name, err)
+		return respError("ERR " + err.Error())
+	}
+	return reply
+}
+
+func serveRESP(conn net.Conn) {
+	c := &respConn{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn), leases: make(map[string]string)}
+	defer conn.Close()
+
+	logger.Infof("Opened RESP connection from: %s", conn.RemoteAddr())
+
+	for {
+		args, err := c.ReadCommand()
+		if err != nil {
+			if err != io.EOF {
+				c.WriteReply(respError("ERR " + err.Error()))
+				c.writer.Flush()
+			}
+			break
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToUpper(args[0])
+		logger.Infof("Received %s command, request id: %s", name, random.String(5))
+
+		if name == "QUIT" {
+			c.WriteReply(respOK)
+			c.writer.Flush()
+			break
+		}
+
+		cmd, known := respCommands[name]
+		switch {
+		case !known:
+			logger.Infof("Invalid command, unknown: %s", name)
+			c.WriteReply(respError(fmt.Sprintf("ERR unknown command '%s'", args[0])))
+		case len(args)-1 < cmd.min || (cmd.max >= 0 && len(args)-1 > cmd.max):
+			logger.Infof("Invalid command, wrong number of arguments for: %s", name)
+			c.WriteReply(respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name))))
+		default:
+			c.WriteReply(respRun(c, name, cmd, args[1:]))
+		}
+
+		//Pipelined commands are answered together.
+		if c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				break
+			}
+		}
+	}
+
+	logger.Infof("Closed RESP connection from: %s", conn.RemoteAddr())
+}
+
+func startRESPServer(stop chan struct{}) {
+	logger.Info("Started RESP Server Gouroutine.")
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", Config.App.RESPPort))
+	if err != nil {
+		logger.Errorf("Unable to listen for RESP connections: %s", err)
+		return
+	}
+
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+
+	logger.Infof("Listening for RESP connections on port %v!", Config.App.RESPPort)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go serveRESP(conn)
+	}
+
+	logger.Info("Stopped RESP Server Goroutine.")
+}
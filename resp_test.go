@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respTestClient sends commands the way redis-cli does and reads back the
+// raw reply lines.
+type respTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRESPTestClient(t *testing.T) (*respTestClient, func()) {
+	client, server := net.Pipe()
+	go serveRESP(server)
+	return &respTestClient{conn: client, reader: bufio.NewReader(client)}, func() { client.Close() }
+}
+
+// do sends a command and returns its reply, with arrays and bulk strings
+// flattened into one line each, separated by spaces.
+func (c *respTestClient) do(t *testing.T, args ...string) string {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write([]byte(command)); err != nil {
+		t.Fatal(err)
+	}
+	return c.read(t)
+}
+
+func (c *respTestClient) read(t *testing.T) string {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "(nil)"
+		}
+		return c.read(t)
+	case '*':
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.read(t)
+		}
+		return strings.Join(items, " ")
+	}
+	return line
+}
+
+func TestRESP(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	c, stop := newRESPTestClient(t)
+	defer stop()
+
+	checks := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"GET", "resp-a"}, "(nil)"},
+		{[]string{"SET", "resp-a", "1"}, "+OK"},
+		{[]string{"GET", "resp-a"}, "1"},
+		{[]string{"INCR", "resp-a"}, ":2"},
+		{[]string{"INCR", "resp-b"}, ":1"},
+		{[]string{"SET", "resp-c", "x", "XX"}, "(nil)"},
+		{[]string{"SET", "resp-c", "x", "NX"}, "+OK"},
+		{[]string{"SET", "resp-c", "y", "NX"}, "(nil)"},
+		{[]string{"INCR", "resp-c"}, "-ERR value is not an integer or out of range"},
+		{[]string{"SET", "resp-c", "y", "PX", "100"}, "-ERR expiry is only supported along with NX, to reserve a key"},
+		{[]string{"EXISTS", "resp-a", "resp-c", "resp-d"}, ":2"},
+		{[]string{"KEYS", "resp-[ab]"}, "resp-a resp-b"},
+		{[]string{"SCAN", "0", "COUNT", "2"}, "2 resp-a resp-b"},
+		{[]string{"SCAN", "2", "COUNT", "2"}, "0 resp-c"},
+		{[]string{"DEL", "resp-b", "resp-d"}, ":1"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	for _, check := range checks {
+		if reply := c.do(t, check.args...); reply != check.reply {
+			t.Errorf("%v should reply %q. Received: %q", check.args, check.reply, reply)
+		}
+	}
+
+	//A reservation locks the key with a new lock id until it runs out.
+	if reply := c.do(t, "SET", "resp-lock", "token", "NX", "PX", "50"); reply != "+OK" {
+		t.Fatalf("Should reserve the key. Received: %q", reply)
+	}
+	if reply := c.do(t, "SET", "resp-lock", "other", "NX", "PX", "50"); reply != "(nil)" {
+		t.Errorf("Should not reserve a reserved key. Received: %q", reply)
+	}
+	if reply := c.do(t, "SET", "resp-lock", "other"); !strings.HasPrefix(reply, "-LOCKED") {
+		t.Errorf("Should not set a reserved key. Received: %q", reply)
+	}
+	entry, err := data.GetEntry("resp-lock")
+	if err != nil || !entry.IsLocked() || entry.ValidLock("token") || entry.GetValue() != "token" {
+		t.Fatalf("Should lock the entry with a lock id of its own, and keep the token as its value.")
+	}
+	if reply := c.do(t, "PEXPIRE", "resp-lock", "200"); reply != ":1" {
+		t.Errorf("Should extend the reservation. Received: %q", reply)
+	}
+	if reply := c.do(t, "PEXPIRE", "resp-a", "200"); reply != ":0" {
+		t.Errorf("Should not expire an unreserved key. Received: %q", reply)
+	}
+	if entry.Expires.IsZero() {
+		t.Errorf("Should keep the lease's deadline with the entry.")
+	}
+
+	//Only the connection holding the lease can release or renew it.
+	other, stopOther := newRESPTestClient(t)
+	defer stopOther()
+	if reply := other.do(t, "DEL", "resp-lock"); reply != ":0" {
+		t.Errorf("Should not delete a key reserved by another connection. Received: %q", reply)
+	}
+	if reply := other.do(t, "PEXPIRE", "resp-lock", "200"); reply != ":0" {
+		t.Errorf("Should not extend a reservation held by another connection. Received: %q", reply)
+	}
+
+	if count := data.ExpireEntries(time.Now().Add(time.Second)); count != 1 || data.EntryExists("resp-lock") {
+		t.Fatalf("Should delete the key when the reservation runs out.")
+	}
+	if reply := c.do(t, "SET", "resp-lock", "token", "NX", "EX", "10"); reply != "+OK" {
+		t.Errorf("Should reserve the key again. Received: %q", reply)
+	}
+	if reply := c.do(t, "DEL", "resp-lock"); reply != ":1" {
+		t.Errorf("Should release the reservation. Received: %q", reply)
+	}
+}
+
+func TestRESPMalformed(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	//A null array is skipped, like an empty line.
+	c, stop := newRESPTestClient(t)
+	defer stop()
+	c.conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := c.conn.Write([]byte("*-1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply := c.do(t, "PING"); reply != "+PONG" {
+		t.Errorf("Should skip a null array. Received: %q", reply)
+	}
+
+	//A line that never ends is refused once it runs past the limit.
+	long, stopLong := newRESPTestClient(t)
+	defer stopLong()
+	long.conn.SetDeadline(time.Now().Add(time.Second))
+	go long.conn.Write([]byte(strings.Repeat("x", 2*respMaxInline)))
+	if reply := long.read(t); reply != "-ERR Protocol error: too big inline request" {
+		t.Errorf("Should refuse an inline request past the limit. Received: %q", reply)
+	}
+}
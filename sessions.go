@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SessionReserve = "reserve"
+	SessionUpdate  = "update"
+	SessionRelease = "release"
+	SessionWatch   = "watch"
+)
+
+// sessionMaxRequests is how many requests, watches included, a session
+// can have running at once.
+const sessionMaxRequests = 64
+
+// SessionRequest is a message from a client over its session's WebSocket.
+// The id is passed back on every reply to it, so replies can be matched
+// up with requests even though they can arrive out of order.
+type SessionRequest struct {
+	Id      string `json:"id,omitempty"`
+	Op      string `json:"op"`
+	Key     string `json:"key,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	LockId  string `json:"lock_id,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Release bool   `json:"release,omitempty"`
+}
+
+// SessionReply answers a SessionRequest. Status is the HTTP status code
+// the same request over HTTP would have got. Watches get a reply for each
+// change, with the change in it.
+type SessionReply struct {
+	Id       string     `json:"id,omitempty"`
+	Status   int        `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Key      string     `json:"key,omitempty"`
+	LockId   string     `json:"lock_id,omitempty"`
+	Value    string     `json:"value,omitempty"`
+	Revision int64      `json:"revision,omitempty"`
+	Change   *WALRecord `json:"change,omitempty"`
+}
+
+// Session is one client's WebSocket connection. Every lock it is granted
+// belongs to the session, and is released as soon as the socket drops.
+type Session struct {
+	sync.Mutex
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+	locks   map[string]string
+	running chan struct{}
+	closed  chan struct{}
+}
+
+// hold records a lock granted to the session. A session that has already
+// closed gives the lock straight back. The entry must be locked.
+func (s *Session) hold(entry *Entry, lockId string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case <-s.closed:
+		entry.UnsetLockId()
+		return false
+	default:
+	}
+
+	s.locks[entry.GetKey()] = lockId
+	return true
+}
+
+func (s *Session) forget(key string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.locks, key)
+}
+
+// close ends the session's watches and releases every lock it holds.
+func (s *Session) close() {
+	s.Lock()
+	close(s.closed)
+	held := s.locks
+	s.locks = nil
+	s.Unlock()
+
+	for key, lockId := range held {
+		entry, err := data.GetEntry(key)
+		if err != nil {
+			continue
+		}
+
+		entry.Lock()
+		if entry.ValidLock(lockId) {
+			logger.Infof("Session closed, removing lock from entry: %s", key)
+			entry.UnsetLockId()
+		}
+		entry.Unlock()
+	}
+}
+
+func (s *Session) send(reply *SessionReply) {
+	j, err := json.Marshal(reply)
+	if err != nil {
+		logger.Errorf("Error marshaling session reply to json: %s", err)
+		return
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if err := s.ws.WriteMessage(websocket.TextMessage, j); err != nil {
+		logger.Debugf("Unable to send session reply: %s", err)
+	}
+}
+
+// handle carries out a request and replies to it. In a cluster, like any
+// other request on the leader, the reply waits until it is committed.
+func (s *Session) handle(req *SessionRequest) {
+	timeout := time.Second * Config.App.TimeOut
+	start := time.Now()
+
+	if cluster != nil {
+		if err := cluster.Ready(timeout); err != nil {
+			s.send(&SessionReply{Id: req.Id, Status: http.StatusServiceUnavailable, Error: err.Error()})
+			return
+		}
+	}
+
+	var reply *SessionReply
+	switch req.Op {
+	case SessionReserve:
+		reply = s.reserve(req)
+	case SessionUpdate:
+		reply = s.update(req)
+	case SessionRelease:
+		reply = s.release(req)
+	case SessionWatch:
+		s.watch(req)
+		return
+	default:
+		logger.Infof("Invalid session request, unknown op: %s", req.Op)
+		reply = &SessionReply{Status: http.StatusBadRequest, Error: "Unknown op."}
+	}
+	reply.Id = req.Id
+
+	if cluster != nil {
+		if err := cluster.Barrier(start, timeout); err != nil {
+			logger.Warnf("Dropping reply to session %s request: %s", req.Op, err)
+			reply = &SessionReply{Id: req.Id, Status: http.StatusServiceUnavailable, Error: err.Error()}
+		}
+	}
+
+	s.send(reply)
+}
+
+// entry looks up the entry a request is about, or says why it can't.
+func (s *Session) entry(req *SessionRequest) (*Entry, *SessionReply) {
+	if req.Key == "" {
+		logger.Info("Invalid session request, no key specified.")
+		return nil, &SessionReply{Status: http.StatusBadRequest, Error: "No key specified."}
+	}
+
+	if shards != nil {
+		ring, _ := shards.Rings()
+		if owner := ring.Owner(req.Key); owner != shards.Id {
+			logger.Infof("Invalid session request, key '%s' belongs to shard: %s", req.Key, owner)
+			return nil, &SessionReply{Key: req.Key, Status: http.StatusMisdirectedRequest, Error: "Key belongs to shard " + owner + "."}
+		}
+	}
+
+	entry, err := data.GetEntry(req.Key)
+	if err != nil {
+		logger.Infof("Invalid session request, entry key not found: %s", req.Key)
+		return nil, &SessionReply{Key: req.Key, Status: http.StatusNotFound, Error: "Entry not found."}
+	}
+	return entry, nil
+}
+
+func (s *Session) reserve(req *SessionRequest) *SessionReply {
+	entry, reply := s.entry(req)
+	if reply != nil {
+		return reply
+	}
+
+	newid := newLockId()
+
+	//Check the LockId, if unlocked, set lock. If locked, acquire lock.
+	entry.Lock()
+	set := entry.SetLockId(newid)
+	entry.Unlock()
+
+	//Looks like someone has it already, attempt an acquisition. The entry
+	//isn't held meanwhile, so a dropped session can release it.
+	if !set {
+		if err := AcquireLock(entry, time.Second*Config.App.TimeOut, newid); err != nil {
+			logger.Info(err)
+			return &SessionReply{Key: req.Key, Status: http.StatusRequestTimeout, Error: err.Error()}
+		}
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !s.hold(entry, newid) {
+		return &SessionReply{Key: req.Key, Status: http.StatusGone, Error: "Session closed."}
+	}
+
+	logger.Infof("Handled successful session reservation for: %s", req.Key)
+	return &SessionReply{Key: req.Key, Status: http.StatusOK, LockId: newid, Value: entry.GetValue(), Revision: entry.GetRevision()}
+}
+
+func (s *Session) update(req *SessionRequest) *SessionReply {
+	entry, reply := s.entry(req)
+	if reply != nil {
+		return reply
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(StringEntry) {
+		logger.Infof("Invalid session request, entry is not a string value: %s", req.Key)
+		return &SessionReply{Key: req.Key, Status: http.StatusConflict, Error: "Entry is not a string value."}
+	}
+
+	if !entry.ValidLock(req.LockId) {
+		logger.Debugf("LockId does not match entry: %s - LockId: %s", req.Key, req.LockId)
+		return &SessionReply{Key: req.Key, Status: http.StatusUnauthorized, Error: "Lock id does not match."}
+	}
+
+	entry.SetValue(req.Value)
+
+	if req.Release {
+		logger.Infof("Removing lock from entry: %s", req.Key)
+		entry.UnsetLockId()
+		s.forget(req.Key)
+	}
+
+	logger.Infof("Handled successful session update for: %s", req.Key)
+	return &SessionReply{Key: req.Key, Status: http.StatusOK, Value: req.Value, Revision: entry.GetRevision()}
+}
+
+func (s *Session) release(req *SessionRequest) *SessionReply {
+	entry, reply := s.entry(req)
+	if reply != nil {
+		return reply
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if req.LockId == "" || !entry.ValidLock(req.LockId) {
+		logger.Debugf("LockId does not match entry: %s - LockId: %s", req.Key, req.LockId)
+		return &SessionReply{Key: req.Key, Status: http.StatusUnauthorized, Error: "Lock id does not match."}
+	}
+
+	logger.Infof("Removing lock from entry: %s", req.Key)
+	entry.UnsetLockId()
+	s.forget(req.Key)
+
+	return &SessionReply{Key: req.Key, Status: http.StatusOK}
+}
+
+// watch sends every change to keys under the prefix until the session
+// closes, in the same form as the change feed.
+func (s *Session) watch(req *SessionRequest) {
+	feed := changes
+	if feed == nil {
+		logger.Info("Invalid session request, no change log is kept.")
+		s.send(&SessionReply{Id: req.Id, Status: http.StatusNotFound, Error: "No change log is kept."})
+		return
+	}
+
+	seq := feed.Seq()
+	s.send(&SessionReply{Id: req.Id, Status: http.StatusOK, Revision: seq})
+
+	for {
+		pending, wake, ok := feed.Since(seq)
+
+		//Changes were missed, so the client has to fetch everything again.
+		if !ok {
+			seq = feed.Seq()
+			s.send(&SessionReply{Id: req.Id, Status: http.StatusGone, Error: "Missed changes.", Revision: seq})
+			continue
+		}
+
+		for _, change := range pending {
+			seq = change.Rev
+			if !strings.HasPrefix(change.Key, req.Prefix) {
+				continue
+			}
+
+			c := *change
+			c.Entry = withoutLock(c.Entry)
+			s.send(&SessionReply{Id: req.Id, Status: http.StatusOK, Key: c.Key, Revision: c.Rev, Change: &c})
+		}
+
+		select {
+		case <-wake:
+		case <-s.closed:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+func openSession(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /sessions, request id: %s", random.String(5))
+
+	if !websocket.IsWebSocketUpgrade(r) {
+		logger.Info("Invalid request, not a WebSocket upgrade.")
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		return
+	}
+
+	//The upgrader answers the request itself when it fails.
+	ws, err := sessionUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Infof("Unable to open session: %s", err)
+		return
+	}
+
+	//The other end is given up on if nothing, not even a pong, arrives
+	//for three heartbeats.
+	idle := streamHeartbeat * 3
+	ws.SetReadLimit(wsMaxMessage)
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(idle))
+	})
+
+	s := &Session{
+		ws:      ws,
+		locks:   make(map[string]string),
+		running: make(chan struct{}, sessionMaxRequests),
+		closed:  make(chan struct{}),
+	}
+	logger.Infof("Opened session from: %s", r.RemoteAddr)
+
+	go func() {
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-heartbeat.C:
+				ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamHeartbeat))
+			case <-s.closed:
+				return
+			case <-done:
+				ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(streamHeartbeat))
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(idle))
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			logger.Debugf("Session read ended: %s", err)
+			break
+		}
+
+		req := &SessionRequest{}
+		if err := json.Unmarshal(message, req); err != nil {
+			logger.Infof("Invalid session request, bad json: %s", err)
+			s.send(&SessionReply{Status: http.StatusBadRequest, Error: "Bad json."})
+			continue
+		}
+		logger.Debugf("Received session request: %v", req)
+
+		select {
+		case s.running <- struct{}{}:
+		default:
+			logger.Infof("Invalid session request, %d already running.", sessionMaxRequests)
+			s.send(&SessionReply{Id: req.Id, Status: http.StatusTooManyRequests, Error: "Too many requests running."})
+			continue
+		}
+
+		go func() {
+			defer func() { <-s.running }()
+			s.handle(req)
+		}()
+	}
+
+	ws.Close()
+	s.close()
+	logger.Infof("Closed session from: %s", r.RemoteAddr)
+}
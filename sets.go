@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/mux"
+)
+
+//Members are kept sorted so membership checks can binary search
+//and listings come back in a stable order.
+
+func (e *Entry) IsMember(member string) bool {
+	// e.Lock()
+	// defer e.Unlock()
+	i := sort.SearchStrings(e.Members, member)
+	return i < len(e.Members) && e.Members[i] == member
+}
+
+func (e *Entry) AddMember(member string) bool {
+	// e.Lock()
+	// defer e.Unlock()
+	i := sort.SearchStrings(e.Members, member)
+	if i < len(e.Members) && e.Members[i] == member {
+		return false
+	}
+	e.Members = append(e.Members, "")
+	copy(e.Members[i+1:], e.Members[i:])
+	e.Members[i] = member
+	e.commit()
+	return true
+}
+
+func (e *Entry) RemoveMember(member string) bool {
+	// e.Lock()
+	// defer e.Unlock()
+	i := sort.SearchStrings(e.Members, member)
+	if i >= len(e.Members) || e.Members[i] != member {
+		return false
+	}
+	e.Members = append(e.Members[:i], e.Members[i+1:]...)
+	e.commit()
+	return true
+}
+
+func (e *Entry) GetMembers() []string {
+	// e.Lock()
+	// defer e.Unlock()
+	members := make([]string, len(e.Members))
+	copy(members, e.Members)
+	return members
+}
+
+func getSetMembers(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /sets/{key}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(SetEntry) {
+		logger.Infof("Invalid request, entry is not a set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	j, err := json.Marshal(entry.GetMembers())
+	if err != nil {
+		logger.Errorf("Error marshaling members to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func getSetCardinality(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /sets/{key}/count, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(SetEntry) {
+		logger.Infof("Invalid request, entry is not a set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	j, err := json.Marshal(map[string]int{"count": len(entry.Members)})
+	if err != nil {
+		logger.Errorf("Error marshaling count to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func isSetMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /sets/{key}/members/{member}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and member.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	member, exists := vars["member"]
+	if !exists {
+		logger.Info("Invalid request, no member specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(SetEntry) {
+		logger.Infof("Invalid request, entry is not a set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !entry.IsMember(member) {
+		logger.Debugf("Not a member of set: %s - %s", key, member)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func addSetMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received PUT request to /sets/{key}/members/{member}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and member.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	member, exists := vars["member"]
+	if !exists {
+		logger.Info("Invalid request, no member specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry if it exists.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Generating new set entry for key: %s", key)
+		logger.Debugf("Received during GetEntry: %s", err)
+
+		//Didn't exist, make a new one!
+		entry = &Entry{Key: key, Type: SetEntry}
+		err = data.AddEntry(entry)
+		if err != nil {
+			logger.Debug(err)
+			entry, _ = data.GetEntry(key)
+		}
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(SetEntry) {
+		logger.Infof("Invalid request, entry is not a set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", key, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !entry.AddMember(member) {
+		logger.Debugf("Already a member of set: %s - %s", key, member)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func removeSetMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received DELETE request to /sets/{key}/members/{member}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and member.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	member, exists := vars["member"]
+	if !exists {
+		logger.Info("Invalid request, no member specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(SetEntry) {
+		logger.Infof("Invalid request, entry is not a set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", key, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !entry.RemoveMember(member) {
+		logger.Infof("Invalid request, not a member of set: %s - %s", key, member)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func combineSets(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /sets, request id: %s", random.String(5))
+
+	op := r.FormValue("op")
+	if op != "union" && op != "intersect" {
+		logger.Infof("Invalid op query specified: %s", op)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 {
+		logger.Info("Invalid request, no keys specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Count how many of the requested sets each member appears in.
+	//Missing keys count as empty sets.
+	counts := make(map[string]int)
+	for _, key := range keys {
+		entry, err := data.GetEntry(key)
+		if err != nil {
+			logger.Debugf("Treating missing key as empty set: %s", key)
+			continue
+		}
+
+		entry.Lock()
+		if !entry.IsType(SetEntry) {
+			entry.Unlock()
+			logger.Infof("Invalid request, entry is not a set: %s", key)
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		for _, m := range entry.Members {
+			counts[m]++
+		}
+		entry.Unlock()
+	}
+
+	members := []string{}
+	for m, c := range counts {
+		if op == "union" || c == len(keys) {
+			members = append(members, m)
+		}
+	}
+	sort.Strings(members)
+
+	j, err := json.Marshal(members)
+	if err != nil {
+		logger.Errorf("Error marshaling members to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful %s of sets: %v", op, keys)
+}
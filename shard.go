@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/mux"
+)
+
+const (
+	shardHeader = "X-Httpdb-Shard"
+
+	//A request passed on to the node that owns its key.
+	shardHopRoute = "route"
+	//A request passed on to the node that owned its key before the last
+	//change to the ring, in case the entry hasn't been moved yet.
+	shardHopHandoff = "handoff"
+)
+
+// Ring is a consistent hash ring. Each node is placed on it at several
+// points, and a key belongs to the first node at or after its own hash,
+// so adding or removing a node only moves the keys next to its points.
+type Ring struct {
+	Nodes  map[string]string
+	points []uint32
+	owners map[uint32]string
+}
+
+func NewRing(nodes map[string]string, vnodes int) *Ring {
+	ring := &Ring{Nodes: nodes, owners: make(map[uint32]string)}
+	for id := range nodes {
+		for i := 0; i < vnodes; i++ {
+			point := ringHash(fmt.Sprintf("%s-%d", id, i))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = id
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// ringHash places a string on the ring. A checksum like crc32 won't do,
+// since similar node names would land right next to each other.
+func ringHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func (r *Ring) Owner(key string) string {
+	if r == nil || len(r.points) == 0 {
+		return ""
+	}
+
+	hash := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Shards is this node's view of the ring, and the one before the last
+// change to it while entries may still be on their way to new owners.
+type Shards struct {
+	sync.Mutex
+	Id   string
+	ring *Ring
+	prev *Ring
+	kick chan struct{}
+}
+
+var shards *Shards
+
+func (s *Shards) Rings() (*Ring, *Ring) {
+	s.Lock()
+	defer s.Unlock()
+	return s.ring, s.prev
+}
+
+// SetNode adds a node to the ring, or moves it if it's already there. An
+// empty address removes it.
+func (s *Shards) SetNode(id, addr string) {
+	s.Lock()
+	nodes := make(map[string]string)
+	for node, a := range s.ring.Nodes {
+		nodes[node] = a
+	}
+	if addr == "" {
+		delete(nodes, id)
+	} else {
+		nodes[id] = addr
+	}
+	s.prev = s.ring
+	s.ring = NewRing(nodes, Config.App.ShardVNodes)
+	s.Unlock()
+
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Misplaced returns the local keys that belong to another node.
+func (s *Shards) Misplaced() []string {
+	ring, _ := s.Rings()
+
+	keys := []string{}
+	seen := make(map[string]struct{})
+
+	data.Lock()
+	for key := range data.Entries {
+		seen[key] = struct{}{}
+		if ring.Owner(key) != s.Id {
+			keys = append(keys, key)
+		}
+	}
+	store := data.Store
+	data.Unlock()
+
+	if store != nil {
+		store.Keys(&KeyRange{}, func(key string) bool {
+			if _, cached := seen[key]; !cached && ring.Owner(key) != s.Id {
+				keys = append(keys, key)
+			}
+			return true
+		})
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Rebalance moves every local entry that belongs to another node over to
+// it. Locked entries stay put until a later pass finds them unlocked.
+func (s *Shards) Rebalance() (int, int) {
+	moved, waiting := 0, 0
+
+	for _, key := range s.Misplaced() {
+		ring, _ := s.Rings()
+		owner := ring.Owner(key)
+		if owner == s.Id {
+			continue
+		}
+
+		entry, err := data.GetEntry(key)
+		if err != nil {
+			continue
+		}
+
+		entry.Lock()
+		if entry.IsLocked() {
+			entry.Unlock()
+			waiting++
+			continue
+		}
+
+		err = s.send(ring.Nodes[owner], entry.State())
+		if err == nil {
+			data.DeleteEntry(key)
+			moved++
+		} else {
+			logger.Warnf("Unable to move '%s' to shard %s: %s", key, owner, err)
+			waiting++
+		}
+		entry.Unlock()
+	}
+
+	return moved, waiting
+}
+
+func (s *Shards) send(addr string, state *EntryState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(addr+"/shard/entries", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	//A conflict means the new owner already has a newer copy.
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("Unexpected response: %s", resp.Status)
+	}
+	return nil
+}
+
+// Adopt takes in an entry moved from another node, unless there is
+// already one under its key here.
+func (d *DataStore) Adopt(s *EntryState) bool {
+	d.Lock()
+	if d.has(s.Key) {
+		d.Unlock()
+		return false
+	}
+	d.load(s)
+	d.Unlock()
+
+	logState(s)
+	return true
+}
+
+func loadShards() {
+	if Config.App.ShardId == "" {
+		return
+	}
+
+	nodes := make(map[string]string)
+	for id, addr := range Config.App.ShardNodes {
+		nodes[id] = strings.TrimRight(addr, "/")
+	}
+	if _, exists := nodes[Config.App.ShardId]; !exists {
+		logger.Fatalf("Shard id %s is not in the list of shard nodes.", Config.App.ShardId)
+	}
+
+	shards = &Shards{
+		Id:   Config.App.ShardId,
+		ring: NewRing(nodes, Config.App.ShardVNodes),
+		kick: make(chan struct{}, 1),
+	}
+	logger.Infof("Joined shard ring as %s with %d nodes.", shards.Id, len(nodes))
+}
+
+// routeKey is the key a request is about, if it is about just one.
+func routeKey(r *http.Request) string {
+	vars := mux.Vars(r)
+	if key, exists := vars["key"]; exists {
+		return key
+	}
+	return vars["name"]
+}
+
+// shardRoute passes requests for keys this node doesn't own on to the
+// node that does. The owner asks the previous owner first for keys it
+// doesn't have yet, in case they haven't been moved over.
+func shardRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := routeKey(r)
+		if shards == nil || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ring, prev := shards.Rings()
+		hop := r.Header.Get(shardHeader)
+
+		if hop == shardHopHandoff {
+			if data.EntryExists(key) {
+				next.ServeHTTP(w, r)
+			} else {
+				w.WriteHeader(http.StatusMisdirectedRequest)
+			}
+			return
+		}
+
+		//A node that was sent the request by another serves it either
+		//way, even if their rings disagree for now.
+		owner := ring.Owner(key)
+		if owner != shards.Id && hop != shardHopRoute {
+			logger.Debugf("Routing request for '%s' to shard: %s", key, owner)
+			shardForward(w, r, ring.Nodes[owner], shardHopRoute)
+			return
+		}
+
+		if prevOwner := prev.Owner(key); prevOwner != "" && prevOwner != shards.Id && !data.EntryExists(key) {
+			if shardForward(w, r, prev.Nodes[prevOwner], shardHopHandoff) {
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shardForward sends the request on to another node and copies back the
+// response, returning false without writing anything if it was a handoff
+// the other node no longer has the entry for.
+func shardForward(w http.ResponseWriter, r *http.Request, addr, hop string) bool {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			logger.Errorf("Error occured reading request body: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return true
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	req, err := http.NewRequest(r.Method, addr+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set(shardHeader, hop)
+
+	resp, err := http.DefaultClient.Do(req.WithContext(r.Context()))
+	if err != nil {
+		logger.Warnf("Unable to reach shard %s: %s", addr, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return true
+	}
+	defer resp.Body.Close()
+
+	if hop == shardHopHandoff && resp.StatusCode == http.StatusMisdirectedRequest {
+		return false
+	}
+
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+func adoptEntry(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /shard/entries, request id: %s", random.String(5))
+
+	state := &EntryState{}
+	if err := json.NewDecoder(r.Body).Decode(state); err != nil || state.Key == "" {
+		logger.Info("Invalid request, bad entry.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if !data.Adopt(state) {
+		logger.Infof("Already have an entry, keeping it: %s", state.Key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	logger.Infof("Handled successful request for: %s", state.Key)
+}
+
+func getShardStatus(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /shard/status, request id: %s", random.String(5))
+
+	if shards == nil {
+		logger.Info("Invalid request, sharding is not enabled.")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ring, _ := shards.Rings()
+
+	j, err := json.Marshal(map[string]interface{}{
+		"id":      shards.Id,
+		"nodes":   ring.Nodes,
+		"pending": len(shards.Misplaced()),
+	})
+	if err != nil {
+		logger.Errorf("Error marshaling shard status to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Info("Handled successful request for shard status.")
+}
+
+// setShardNode adds, moves or, for DELETE, removes a node. Unless it came
+// from another node, the change is passed on to every other node too.
+func setShardNode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received %s request to /shard/nodes/{id}, request id: %s", r.Method, random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	if shards == nil {
+		logger.Info("Invalid request, sharding is not enabled.")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := vars["id"]
+	addr := ""
+	if r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logger.Errorf("Error occured reading request body: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		addr = strings.TrimRight(strings.TrimSpace(string(body)), "/")
+		if addr == "" {
+			logger.Info("Invalid request, no node address.")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	ring, _ := shards.Rings()
+	shards.SetNode(id, addr)
+
+	if r.Header.Get(shardHeader) == "" {
+		for node, nodeAddr := range ring.Nodes {
+			if node == shards.Id {
+				continue
+			}
+			req, err := http.NewRequest(r.Method, nodeAddr+r.URL.RequestURI(), strings.NewReader(addr))
+			if err != nil {
+				continue
+			}
+			req.Header.Set(shardHeader, shardHopRoute)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				logger.Warnf("Unable to pass ring change on to shard %s: %s", node, err)
+				continue
+			}
+			resp.Body.Close()
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful ring change for shard: %s", id)
+}
+
+func startRebalancer(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+
+	logger.Info("Started Rebalancer Gouroutine.")
+	for {
+		select {
+
+		case <-ticker.C:
+		case <-shards.kick:
+
+		case <-stop:
+			logger.Info("Stopped Rebalancer Goroutine.")
+			return
+
+		}
+
+		moved, waiting := shards.Rebalance()
+		if moved > 0 || waiting > 0 {
+			logger.Infof("Moved %d entries to other shards, %d still waiting.", moved, waiting)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	three := NewRing(map[string]string{"a": "", "b": "", "c": ""}, 64)
+	four := NewRing(map[string]string{"a": "", "b": "", "c": "", "d": ""}, 64)
+
+	counts := make(map[string]int)
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := three.Owner(key)
+		counts[owner]++
+
+		if next := four.Owner(key); next != owner {
+			moved++
+			if next != "d" {
+				t.Fatalf("Keys should only move to the new node. Moved '%s' from %s to %s.", key, owner, next)
+			}
+		}
+	}
+
+	for node, count := range counts {
+		if count < 500 {
+			t.Errorf("Keys should be spread evenly. Node %s owns %d of 3000.", node, count)
+		}
+	}
+
+	if moved == 0 || moved > 1500 {
+		t.Errorf("About a quarter of the keys should move. Moved: %d", moved)
+	}
+}
+
+func TestShardRebalance(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	var mu sync.Mutex
+	adopted := []string{}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/shard/entries":
+			var s EntryState
+			json.NewDecoder(r.Body).Decode(&s)
+			mu.Lock()
+			adopted = append(adopted, s.Key)
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.Header().Set("X-Served-By", "b")
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer other.Close()
+
+	Config.App.ShardVNodes = 64
+	shards = &Shards{
+		Id:   "a",
+		ring: NewRing(map[string]string{"a": "http://unused"}, 64),
+		kick: make(chan struct{}, 1),
+	}
+	defer func() { shards = nil }()
+
+	keys := []string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		keys = append(keys, key)
+		data.NewEntry(key)
+	}
+
+	shards.SetNode("b", other.URL)
+	ring, _ := shards.Rings()
+
+	//Keep one of b's keys locked.
+	var held string
+	for _, key := range keys {
+		if ring.Owner(key) == "b" {
+			held = key
+			break
+		}
+	}
+	if held == "" {
+		t.Fatal("Node b should own some of the keys.")
+	}
+	entry, _ := data.GetEntry(held)
+	entry.SetLockId("lock")
+
+	moved, waiting := shards.Rebalance()
+	if waiting != 1 || moved != len(adopted) || moved == 0 {
+		t.Errorf("Should move every unlocked entry b owns. Moved: %d, waiting: %d", moved, waiting)
+	}
+
+	for _, key := range keys {
+		if exists := data.EntryExists(key); exists != (ring.Owner(key) == "a" || key == held) {
+			t.Errorf("Only a's keys and the locked one should be left. Key '%s' exists: %v", key, exists)
+		}
+	}
+
+	entry.UnsetLockId()
+	if moved, _ := shards.Rebalance(); moved != 1 || data.EntryExists(held) {
+		t.Error("The locked entry should move once unlocked.")
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf(putValUrl, held), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if w.Header().Get("X-Served-By") != "b" {
+		t.Error("Requests for b's keys should be passed on to b.")
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SnapshotVersion = 2
+	SnapshotsKept   = 2
+
+	snapshotMagic = "HTTPDBSNAP"
+	snapshotEnd   = "HTTPDBEND"
+	snapshotGlob  = "snapshot-*.snap"
+)
+
+// A snapshot file is a header line, a line of JSON with everything but
+// the entries, one line of JSON per entry, and a line closing it off:
+//
+//	HTTPDBSNAP <version>
+//	{"time": ...}
+//	{"key": ...}
+//	HTTPDBEND <body length> <crc32 of body>
+//
+// so it can be written out as the entries are read, and a file torn by a
+// crash is caught before any of it is loaded. Version 1 files, with the
+// length and checksum in the header and the body as a single JSON
+// object, are still read. The snapshots a cluster node compacts its raft
+// log behind also carry the index and term of the last log entry they
+// cover.
+type Snapshot struct {
+	Time    time.Time     `json:"time"`
+	Rev     int64         `json:"rev,omitempty"`
+	Index   int64         `json:"index,omitempty"`
+	Term    int64         `json:"term,omitempty"`
+	Entries []*EntryState `json:"entries,omitempty"`
+}
+
+// SnapshotWriter writes a snapshot one entry at a time, so the whole of
+// it never has to be held in memory.
+type SnapshotWriter struct {
+	w      io.Writer
+	sum    hash.Hash32
+	length int
+	count  int
+}
+
+// NewSnapshotWriter writes the header and everything in snap but its
+// entries, which are written with Write.
+func NewSnapshotWriter(w io.Writer, snap *Snapshot) (*SnapshotWriter, error) {
+	if _, err := fmt.Fprintf(w, "%s %d\n", snapshotMagic, SnapshotVersion); err != nil {
+		return nil, err
+	}
+
+	s := &SnapshotWriter{w: w, sum: crc32.NewIEEE()}
+	meta := *snap
+	meta.Entries = nil
+	return s, s.line(&meta)
+}
+
+func (s *SnapshotWriter) Write(state *EntryState) error {
+	s.count++
+	return s.line(state)
+}
+
+// Count is how many entries have been written.
+func (s *SnapshotWriter) Count() int {
+	return s.count
+}
+
+// Close ends the snapshot with the length and checksum of its body. It
+// doesn't close the underlying writer.
+func (s *SnapshotWriter) Close() error {
+	_, err := fmt.Fprintf(s.w, "%s %d %08x\n", snapshotEnd, s.length, s.sum.Sum32())
+	return err
+}
+
+func (s *SnapshotWriter) line(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal snapshot: %s", err)
+	}
+
+	line = append(line, '\n')
+	s.sum.Write(line)
+	s.length += len(line)
+	_, err = s.w.Write(line)
+	return err
+}
+
+func WriteSnapshot(dir string, snap *Snapshot) (string, error) {
+	tmp, err := ioutil.TempFile(dir, "snapshot-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("Unable to create snapshot file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = EncodeSnapshot(tmp, snap); err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return "", fmt.Errorf("Unable to write snapshot file: %s", err)
+	}
+
+	//Only a complete file ever gets a snapshot name.
+	path := filepath.Join(dir, fmt.Sprintf("snapshot-%020d.snap", snap.Time.UnixNano()))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", fmt.Errorf("Unable to rename snapshot file: %s", err)
+	}
+
+	return path, nil
+}
+
+// EncodeSnapshot writes the whole snapshot to w.
+func EncodeSnapshot(w io.Writer, snap *Snapshot) error {
+	s, err := NewSnapshotWriter(w, snap)
+	if err != nil {
+		return err
+	}
+	for _, state := range snap.Entries {
+		if err := s.Write(state); err != nil {
+			return err
+		}
+	}
+	return s.Close()
+}
+
+func ReadSnapshot(path string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open snapshot: %s", err)
+	}
+	defer file.Close()
+
+	return DecodeSnapshot(file, path)
+}
+
+// DecodeSnapshot reads a snapshot from r, checking its header and
+// checksum before returning any of it. The name is only used in errors.
+func DecodeSnapshot(r io.Reader, name string) (*Snapshot, error) {
+	reader := bufio.NewReader(r)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read snapshot header: %s", name)
+	}
+
+	fields := strings.Fields(header)
+	version := 0
+	if len(fields) > 1 {
+		version, _ = strconv.Atoi(fields[1])
+	}
+	if version < 1 || fields[0] != snapshotMagic {
+		return nil, fmt.Errorf("Invalid snapshot header: %s", name)
+	}
+
+	if version > SnapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %d: %s", version, name)
+	}
+
+	if version == 1 {
+		return decodeSnapshotV1(reader, fields, name)
+	}
+
+	snap := (*Snapshot)(nil)
+	sum := crc32.NewIEEE()
+	length := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot is cut short: %s", name)
+		}
+
+		if bytes.HasPrefix(line, []byte(snapshotEnd+" ")) {
+			var endLength int
+			var endSum uint32
+			_, err := fmt.Sscanf(string(line), snapshotEnd+" %d %x\n", &endLength, &endSum)
+			if err != nil || snap == nil || endLength != length || endSum != sum.Sum32() {
+				return nil, fmt.Errorf("Snapshot checksum mismatch: %s", name)
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				return nil, fmt.Errorf("Snapshot has data past its end: %s", name)
+			}
+			return snap, nil
+		}
+
+		sum.Write(line)
+		length += len(line)
+
+		if snap == nil {
+			snap = &Snapshot{}
+			err = json.Unmarshal(line, snap)
+		} else {
+			s := &EntryState{}
+			err = json.Unmarshal(line, s)
+			snap.Entries = append(snap.Entries, s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse snapshot: %s", err)
+		}
+	}
+}
+
+// decodeSnapshotV1 reads the body of a version 1 snapshot, which has its
+// length and checksum in the header.
+func decodeSnapshotV1(reader *bufio.Reader, header []string, name string) (*Snapshot, error) {
+	var length int
+	var sum uint64
+	var err error
+	if len(header) == 4 {
+		if length, err = strconv.Atoi(header[2]); err == nil {
+			sum, err = strconv.ParseUint(header[3], 16, 32)
+		}
+	}
+	if len(header) != 4 || err != nil {
+		return nil, fmt.Errorf("Invalid snapshot header: %s", name)
+	}
+
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, reader); err != nil {
+		return nil, fmt.Errorf("Unable to read snapshot body: %s", err)
+	}
+
+	if body.Len() != length || crc32.ChecksumIEEE(body.Bytes()) != uint32(sum) {
+		return nil, fmt.Errorf("Snapshot checksum mismatch: %s", name)
+	}
+
+	snap := &Snapshot{}
+	if err := json.Unmarshal(body.Bytes(), snap); err != nil {
+		return nil, fmt.Errorf("Unable to parse snapshot: %s", err)
+	}
+
+	return snap, nil
+}
+
+// listSnapshots returns the snapshot files in dir, newest first.
+func listSnapshots(dir string) []string {
+	paths, _ := filepath.Glob(filepath.Join(dir, snapshotGlob))
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	return paths
+}
+
+// LoadLatestSnapshot fills the DataStore from the newest snapshot. The
+// write-ahead log from before it was dropped when it was taken, so if it
+// doesn't pass its checksum, falling back to an older one would quietly
+// lose every write in between. That is left to the operator instead, by
+// moving the broken snapshot aside.
+func LoadLatestSnapshot(dir string, d *DataStore) (string, error) {
+	for _, path := range listSnapshots(dir) {
+		snap, err := ReadSnapshot(path)
+		if err != nil {
+			return "", fmt.Errorf("Newest snapshot is unusable, and the write-ahead log it covers is gone. Move it aside to start from an older one, without the writes in between: %s", err)
+		}
+
+		d.Lock()
+		for _, s := range snap.Entries {
+			d.load(s)
+		}
+		d.Unlock()
+		changes.Observe(snap.Rev)
+
+		return path, nil
+	}
+	return "", nil
+}
+
+// takeSnapshot writes the whole DataStore to a new snapshot and then
+// drops the part of the write-ahead log it covers.
+func takeSnapshot() error {
+	var compacted string
+	if wal != nil {
+		var err error
+		compacted, err = wal.Rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	//The revision is read after the states, so it covers all of them.
+	snap := &Snapshot{Time: time.Now(), Entries: data.States()}
+	snap.Rev = changes.Seq()
+	if !persistLocks() {
+		for i, s := range snap.Entries {
+			snap.Entries[i] = withoutLock(s)
+		}
+	}
+
+	path, err := WriteSnapshot(Config.App.SnapshotDir, snap)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Wrote snapshot of %d entries to: %s", len(snap.Entries), path)
+
+	if compacted != "" {
+		if err := os.Remove(compacted); err != nil {
+			logger.Errorf("Unable to remove compacted write-ahead log: %s", err)
+		}
+	}
+
+	for i, old := range listSnapshots(Config.App.SnapshotDir) {
+		if i >= SnapshotsKept {
+			logger.Debugf("Removing old snapshot: %s", old)
+			os.Remove(old)
+		}
+	}
+
+	return nil
+}
+
+func loadSnapshot() {
+	if Config.App.SnapshotDir == "" {
+		return
+	}
+
+	if err := os.MkdirAll(Config.App.SnapshotDir, 0755); err != nil {
+		logger.Fatal(err)
+	}
+
+	path, err := LoadLatestSnapshot(Config.App.SnapshotDir, &data)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	if path == "" {
+		logger.Info("No valid snapshot found, starting from the write-ahead log alone.")
+		return
+	}
+	logger.Infof("Loaded %d entries from snapshot: %s", len(data.Entries), path)
+}
+
+func startSnapshotter(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second * Config.App.SnapshotInterval)
+	defer ticker.Stop()
+
+	logger.Info("Started Snapshotter Gouroutine.")
+	for {
+		select {
+
+		case <-ticker.C:
+			if err := takeSnapshot(); err != nil {
+				logger.Errorf("Error taking snapshot: %s", err)
+			}
+
+		case <-stop:
+			logger.Info("Stopped Snapshotter Goroutine.")
+			return
+
+		}
+	}
+}
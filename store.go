@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	StoreMemory = "memory"
+	StoreFile   = "file"
+)
+
+// Store is a backend the DataStore keeps its entries in. Without one,
+// DataStore.Entries is the whole data set and everything lives in memory.
+// With one, DataStore.Entries only caches the entries in use: they are
+// read from the Store on first access, written back after every change,
+// and dropped from memory again once they've been idle for a while. Keys
+// are read from the Store in order as well, so they needn't fit in memory
+// either.
+type Store interface {
+	Get(key string) (*EntryState, bool, error)
+	Put(s *EntryState) error
+	Delete(key string) error
+	Scan(start string, fn func(*EntryState) bool) error
+	Keys(r *KeyRange, fn func(key string) bool) error
+	Len() int
+	Close() error
+}
+
+// commit persists the entry after a change, to the write-ahead log and
+// the backing Store. Entries that are no longer in the DataStore are left
+// alone, so a late write can't bring a deleted key back.
+func (e *Entry) commit() {
+	if !data.Owns(e) {
+		return
+	}
+	e.logPut()
+	data.writeBack(e)
+}
+
+func (d *DataStore) Owns(e *Entry) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.Entries[e.Key] == e
+}
+
+//The methods below expect the DataStore lock to be held.
+
+func (d *DataStore) has(key string) bool {
+	if _, exists := d.Entries[key]; exists {
+		return true
+	}
+	if d.Store == nil {
+		return false
+	}
+	_, exists, err := d.Store.Get(key)
+	if err != nil {
+		logger.Error(err)
+	}
+	return exists
+}
+
+// lookup returns the live entry for key, reading it in from the Store
+// if it isn't cached.
+func (d *DataStore) lookup(key string) (*Entry, error) {
+	if entry, exists := d.Entries[key]; exists {
+		entry.used = time.Now()
+		return entry, nil
+	}
+
+	if d.Store == nil {
+		return nil, fmt.Errorf("Cannot get entry '%s', does not exist.", key)
+	}
+
+	s, exists, err := d.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("Cannot get entry '%s', does not exist.", key)
+	}
+
+	entry := s.Entry()
+	entry.used = time.Now()
+	d.Entries[key] = entry
+	return entry, nil
+}
+
+func (d *DataStore) writeBack(e *Entry) {
+	if d.Store == nil {
+		return
+	}
+
+	//Locks don't outlive the process, and locked entries are never
+	//evicted, so the Store never needs to know about them.
+	s := e.State()
+	s.LockId = ""
+
+	if err := d.Store.Put(s); err != nil {
+		logger.Error(err)
+	}
+}
+
+// add caches a brand new entry.
+func (d *DataStore) add(entry *Entry) {
+	d.Entries[entry.Key] = entry
+	d.index.Insert(entry.Key)
+	d.expiries.Set(entry.Key, entry.Expires)
+}
+
+// setValue is the same as SetValue, minus the ownership check in commit,
+// which would need the DataStore lock that is already held. The entry
+// must be locked too.
+func (d *DataStore) setValue(entry *Entry, value string) {
+	entry.Value = value
+	entry.Revision++
+	entry.addHistory(Revision{Revision: entry.Revision, Value: value, Time: time.Now()})
+	entry.logPut()
+	d.writeBack(entry)
+}
+
+// ordered returns the keys in order: the Store's, which holds every key
+// once there is one, or else the key index, built the first time.
+func (d *DataStore) ordered() KeyOrder {
+	if d.Store != nil {
+		return storeOrder{d.Store}
+	}
+	if d.index != nil {
+		return d.index
+	}
+
+	d.index = NewKeyIndex()
+	for key := range d.Entries {
+		d.index.Insert(key)
+	}
+	return d.index
+}
+
+// load and unload apply restored state, from a snapshot or a log replay.
+func (d *DataStore) load(s *EntryState) {
+	d.index.Insert(s.Key)
+	d.expiries.Set(s.Key, s.expiry())
+
+	if d.Store == nil {
+		d.Entries[s.Key] = s.Entry()
+		return
+	}
+
+	delete(d.Entries, s.Key)
+	if err := d.Store.Put(s); err != nil {
+		logger.Error(err)
+	}
+}
+
+func (d *DataStore) unload(key string) {
+	delete(d.Entries, key)
+	d.index.Remove(key)
+	d.expiries.Set(key, time.Time{})
+	if d.Store == nil {
+		return
+	}
+
+	if err := d.Store.Delete(key); err != nil {
+		logger.Error(err)
+	}
+}
+
+// Evict drops cached entries that haven't been used since before the
+// cutoff. Locked entries stay, and each entry's own lock is taken first
+// so nobody is halfway through changing it.
+func (d *DataStore) Evict(cutoff time.Time) int {
+	if d.Store == nil {
+		return 0
+	}
+
+	d.Lock()
+	idle := []*Entry{}
+	for _, entry := range d.Entries {
+		if entry.used.Before(cutoff) {
+			idle = append(idle, entry)
+		}
+	}
+	d.Unlock()
+
+	count := 0
+	for _, entry := range idle {
+		entry.Lock()
+		d.Lock()
+		if d.Entries[entry.Key] == entry && entry.used.Before(cutoff) && !entry.IsLocked() {
+			delete(d.Entries, entry.Key)
+			count++
+		}
+		d.Unlock()
+		entry.Unlock()
+	}
+	return count
+}
+
+func loadStore() {
+	switch Config.App.Store {
+	case StoreMemory:
+		logger.Info("Keeping all entries in memory.")
+		return
+	case StoreFile:
+		store, err := OpenFileStore(Config.App.StorePath, Config.App.WALFsync)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		data.Store = store
+		loadExpiries()
+		logger.Infof("Opened file store with %d entries: %s", store.Len(), Config.App.StorePath)
+	}
+}
+
+func startCacheEvictor(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second * Config.App.CacheIdle / 2)
+	defer ticker.Stop()
+
+	logger.Info("Started Cache Evictor Gouroutine.")
+	for {
+		select {
+
+		case <-ticker.C:
+			count := data.Evict(time.Now().Add(-time.Second * Config.App.CacheIdle))
+			logger.Debugf("Evicted %d idle entries from the cache.", count)
+
+		case <-stop:
+			logger.Info("Stopped Cache Evictor Goroutine.")
+			return
+
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "httpdb.db")
+
+	store, err := OpenFileStore(path, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"c", "a", "b", "d"} {
+		if err := store.Put(&EntryState{Key: key, Value: "value-" + key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Put(&EntryState{Key: "a", Value: "updated"})
+	store.Delete("d")
+	store.Close()
+
+	store, err = OpenFileStore(path, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if s, exists, _ := store.Get("a"); !exists || s.Value != "updated" {
+		t.Error("Reopened store should have the latest value.")
+	}
+
+	if _, exists, _ := store.Get("d"); exists {
+		t.Error("Deleted key should stay deleted.")
+	}
+
+	keys := []string{}
+	store.Scan("b", func(s *EntryState) bool {
+		keys = append(keys, s.Key)
+		return true
+	})
+
+	if strings.Join(keys, ",") != "b,c" {
+		t.Errorf("Scan should return keys in order from the start key. Returned: %v", keys)
+	}
+}
+
+func TestFileStoreKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenFileStore(filepath.Join(dir, "httpdb.db"), FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	//More keys than a scan reads at once.
+	for i := 0; i < fileScanBatch*2+10; i++ {
+		store.Put(&EntryState{Key: fmt.Sprintf("k%04d", i)})
+	}
+
+	keys := func(r *KeyRange) []string {
+		keys := []string{}
+		store.Keys(r, func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+
+	if all := keys(&KeyRange{}); len(all) != fileScanBatch*2+10 || all[0] != "k0000" || !sort.StringsAreSorted(all) {
+		t.Errorf("Should read every key in order. Read %d.", len(all))
+	}
+
+	checks := []struct {
+		r    *KeyRange
+		keys string
+	}{
+		{&KeyRange{Start: "k0010", End: "k0013"}, "k0010,k0011,k0012"},
+		{&KeyRange{Start: "k0010", End: "k0013", StartExclusive: true, EndInclusive: true}, "k0011,k0012,k0013"},
+		{&KeyRange{Start: "k0010", End: "k0013", Reverse: true}, "k0012,k0011,k0010"},
+		{&KeyRange{Start: "k0010", End: "k0013", StartExclusive: true, EndInclusive: true, Reverse: true}, "k0013,k0012,k0011"},
+		{&KeyRange{Start: "k0519", End: "k1", StartExclusive: true, Reverse: true}, "k0521,k0520"},
+		{&KeyRange{Start: "k0520", End: "k1"}, "k0520,k0521"},
+		{&KeyRange{Start: "z"}, ""},
+	}
+	for _, check := range checks {
+		if got := strings.Join(keys(check.r), ","); got != check.keys {
+			t.Errorf("Range %+v should hold %q. Read: %q", *check.r, check.keys, got)
+		}
+	}
+
+	if count := len(keys(&KeyRange{Reverse: true})); count != fileScanBatch*2+10 {
+		t.Errorf("Should read every key in reverse. Read %d.", count)
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	index := NewKeyIndex()
+	for i := 0; i < 1000; i++ {
+		index.Insert(fmt.Sprintf("k%04d", i))
+	}
+	index.Insert("k0010")
+	index.Remove("k0011")
+	index.Remove("missing")
+
+	checks := []struct {
+		r      *KeyRange
+		offset int
+		limit  int
+		keys   string
+	}{
+		{&KeyRange{Start: "k0010", End: "k0013"}, 0, 0, "k0010,k0012"},
+		{&KeyRange{Start: "k0010", End: "k0013", StartExclusive: true, EndInclusive: true}, 0, 0, "k0012,k0013"},
+		{&KeyRange{Start: "k0009", End: "k0013", Reverse: true}, 0, 0, "k0012,k0010,k0009"},
+		{&KeyRange{Start: "k0009", End: "k0013", EndInclusive: true, Reverse: true}, 1, 2, "k0012,k0010"},
+		{&KeyRange{Start: "k0998"}, 0, 0, "k0998,k0999"},
+		{&KeyRange{Reverse: true}, 0, 2, "k0999,k0998"},
+		{&KeyRange{}, 998, 5, "k0999"},
+		{&KeyRange{Start: "z"}, 0, 0, ""},
+	}
+	for _, check := range checks {
+		if got := strings.Join(index.Range(check.r, check.offset, check.limit), ","); got != check.keys {
+			t.Errorf("Range %+v from %d should hold %q. Read: %q", *check.r, check.offset, check.keys, got)
+		}
+	}
+
+	if count := index.Count(&KeyRange{}); count != 999 {
+		t.Errorf("Should count every key. Counted %d.", count)
+	}
+	if count := index.Count(PrefixRange("k001")); count != 9 {
+		t.Errorf("Should count the keys in a range. Counted %d.", count)
+	}
+}
+
+func TestRangeSkipsDeleted(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	for _, key := range []string{"a", "d", "e"} {
+		data.NewEntry(key)
+	}
+
+	//Keys deleted between reading the index and reading their entries.
+	data.Lock()
+	data.ordered()
+	data.index.Insert("b")
+	data.index.Insert("c")
+	data.Unlock()
+
+	states, cursor := data.Range(&KeyRange{}, 2)
+	if len(states) != 2 || states[0].Key != "a" || states[1].Key != "d" || cursor != "d" {
+		t.Fatalf("Should read past deleted keys to fill the page. Received %d entries and cursor %q.", len(states), cursor)
+	}
+
+	states, cursor = data.Range((&KeyRange{}).After(cursor), 2)
+	if len(states) != 1 || states[0].Key != "e" || cursor != "" {
+		t.Errorf("Should end at the last page. Received %d entries and cursor %q.", len(states), cursor)
+	}
+}
+
+func TestDataStoreWithFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := OpenFileStore(filepath.Join(dir, "httpdb.db"), FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	data = DataStore{Entries: make(map[string]*Entry), Store: store}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	defer func() {
+		data = DataStore{Entries: make(map[string]*Entry)}
+	}()
+
+	entry, _ := data.NewEntry("key")
+	entry.SetValue("value")
+
+	locked, _ := data.NewEntry("locked")
+	locked.SetLockId("lock")
+
+	if count := data.Evict(time.Now()); count != 1 {
+		t.Errorf("Only the unlocked entry should be evicted. Evicted: %d", count)
+	}
+
+	listed, _ := data.List("", "", 10)
+	if len(listed) != 2 || listed[0].Key != "key" || listed[0].Value != "value" || listed[1].LockId != "lock" {
+		t.Error("Listing should include evicted entries, and cached ones as they are now.")
+	}
+	if _, cached := data.Entries["key"]; cached {
+		t.Error("Listing should not cache evicted entries.")
+	}
+
+	if _, cached := data.Entries["key"]; cached {
+		t.Error("Evicted entry should not be cached.")
+	}
+
+	if !data.EntryExists("key") {
+		t.Error("Evicted entry should still exist in the store.")
+	}
+
+	reloaded, err := data.GetEntry("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reloaded == entry || reloaded.GetValue() != "value" || reloaded.GetRevision() != 1 {
+		t.Error("Entry should be read back from the store.")
+	}
+
+	//A write through the stale copy must not reach the store.
+	entry.SetValue("stale")
+	if s, _, _ := store.Get("key"); s.Value != "value" {
+		t.Error("Evicted entry should no longer write back.")
+	}
+
+	data.DeleteEntry("key")
+	if _, exists, _ := store.Get("key"); exists {
+		t.Error("Deleted entry should be removed from the store.")
+	}
+
+	if len(data.States()) != 1 {
+		t.Error("States should include every stored entry.")
+	}
+}
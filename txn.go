@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+const (
+	TxnPut    = "put"
+	TxnDelete = "delete"
+)
+
+// TxnCompare is a condition on one key. Every field that is set has to
+// hold for it to pass. A key that doesn't exist only passes exists=false
+// and unlocked=true.
+type TxnCompare struct {
+	Key      string  `json:"key"`
+	Value    *string `json:"value,omitempty"`
+	Revision *int64  `json:"revision,omitempty"`
+	Exists   *bool   `json:"exists,omitempty"`
+	Unlocked *bool   `json:"unlocked,omitempty"`
+}
+
+// TxnOp is a write made by a transaction. Locked entries can only be
+// written with their LockId, and Release gives the lock up afterwards.
+type TxnOp struct {
+	Op      string `json:"op"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	LockId  string `json:"lock_id,omitempty"`
+	Release bool   `json:"release,omitempty"`
+}
+
+// Txn runs Then if every comparison passes, or Else if any fails, all
+// without anything else seeing or changing the keys in between.
+type Txn struct {
+	Compare []*TxnCompare `json:"compare"`
+	Then    []*TxnOp      `json:"then"`
+	Else    []*TxnOp      `json:"else"`
+}
+
+// TxnError is why a transaction couldn't be carried out. Nothing in it
+// was applied.
+type TxnError struct {
+	Status int
+	Key    string
+	Reason string
+}
+
+func (e *TxnError) Error() string {
+	return e.Reason
+}
+
+func (c *TxnCompare) Validate() error {
+	if c.Key == "" {
+		return fmt.Errorf("Comparison has no key.")
+	}
+	if c.Value == nil && c.Revision == nil && c.Exists == nil && c.Unlocked == nil {
+		return fmt.Errorf("Comparison on '%s' has nothing to compare.", c.Key)
+	}
+	return nil
+}
+
+func (c *TxnCompare) Matches(entry *Entry) bool {
+	if entry == nil {
+		return c.Value == nil && c.Revision == nil && (c.Exists == nil || !*c.Exists) && (c.Unlocked == nil || *c.Unlocked)
+	}
+
+	if c.Exists != nil && !*c.Exists {
+		return false
+	}
+	if c.Unlocked != nil && *c.Unlocked == entry.IsLocked() {
+		return false
+	}
+	if c.Value != nil && (!entry.IsType(StringEntry) || entry.GetValue() != *c.Value) {
+		return false
+	}
+	if c.Revision != nil && (!entry.IsType(StringEntry) || entry.GetRevision() != *c.Revision) {
+		return false
+	}
+	return true
+}
+
+func (o *TxnOp) Validate() error {
+	if o.Key == "" {
+		return fmt.Errorf("Operation has no key.")
+	}
+	if o.Op != TxnPut && o.Op != TxnDelete {
+		return fmt.Errorf("Unknown transaction operation: %s", o.Op)
+	}
+	return nil
+}
+
+// Validate checks the transaction is well formed and small enough, and,
+// with sharding, that this node holds every key in it.
+func (t *Txn) Validate() error {
+	for _, c := range t.Compare {
+		if c == nil {
+			return &TxnError{Status: http.StatusBadRequest, Reason: "Comparison can't be null."}
+		}
+		if err := c.Validate(); err != nil {
+			return &TxnError{Status: http.StatusBadRequest, Key: c.Key, Reason: err.Error()}
+		}
+	}
+	for _, op := range append(append([]*TxnOp{}, t.Then...), t.Else...) {
+		if op == nil {
+			return &TxnError{Status: http.StatusBadRequest, Reason: "Op can't be null."}
+		}
+		if err := op.Validate(); err != nil {
+			return &TxnError{Status: http.StatusBadRequest, Key: op.Key, Reason: err.Error()}
+		}
+	}
+
+	keys := t.Keys()
+	if len(keys) > batchMax {
+		return &TxnError{Status: http.StatusRequestEntityTooLarge, Reason: fmt.Sprintf("Transaction is over the limit of %d keys.", batchMax)}
+	}
+
+	//Keys held elsewhere can't be locked along with the rest.
+	if shards != nil {
+		ring, _ := shards.Rings()
+		for _, key := range keys {
+			if owner := ring.Owner(key); owner != shards.Id {
+				return &TxnError{Status: http.StatusMisdirectedRequest, Key: key, Reason: "Key belongs to shard " + owner + "."}
+			}
+		}
+	}
+	return nil
+}
+
+// Keys returns every key the transaction touches, once each.
+func (t *Txn) Keys() []string {
+	seen := make(map[string]struct{})
+	keys := []string{}
+	add := func(key string) {
+		if _, exists := seen[key]; !exists {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+
+	//Null comparisons and ops are refused by Validate, but the keys are
+	//still logged.
+	for _, c := range t.Compare {
+		if c != nil {
+			add(c.Key)
+		}
+	}
+	for _, op := range append(append([]*TxnOp{}, t.Then...), t.Else...) {
+		if op != nil {
+			add(op.Key)
+		}
+	}
+	return keys
+}
+
+// checkTxnOps makes sure every op can be applied before any of them are,
+// following each op's effect on the ones after it.
+func checkTxnOps(ops []*TxnOp, entries map[string]*Entry) error {
+	exists := make(map[string]bool)
+	lockIds := make(map[string]string)
+	for key, entry := range entries {
+		exists[key] = true
+		lockIds[key] = entry.GetLockId()
+	}
+
+	for _, op := range ops {
+		if entry, cached := entries[op.Key]; cached && exists[op.Key] && op.Op == TxnPut && !entry.IsType(StringEntry) {
+			return &TxnError{Status: http.StatusConflict, Key: op.Key, Reason: "Entry is not a string value."}
+		}
+		if lockIds[op.Key] != "" && lockIds[op.Key] != op.LockId {
+			return &TxnError{Status: http.StatusUnauthorized, Key: op.Key, Reason: "Lock id does not match."}
+		}
+
+		switch op.Op {
+		case TxnPut:
+			exists[op.Key] = true
+			if op.Release {
+				lockIds[op.Key] = ""
+			}
+		case TxnDelete:
+			exists[op.Key] = false
+			lockIds[op.Key] = ""
+		}
+	}
+	return nil
+}
+
+// Commit carries out the transaction. It returns whether the comparisons
+// passed, and a result for each op run, with the status code the same
+// request for just that key would have got.
+func (d *DataStore) Commit(t *Txn) (bool, []*BatchResult, error) {
+	var succeeded bool
+	var results []*BatchResult
+	var failed error
+	deleted := []string{}
+
+	d.Hold(t.Keys(), func(entries map[string]*Entry) {
+		succeeded = true
+		for _, c := range t.Compare {
+			if !c.Matches(entries[c.Key]) {
+				succeeded = false
+				break
+			}
+		}
+
+		ops := t.Then
+		if !succeeded {
+			ops = t.Else
+		}
+
+		if failed = checkTxnOps(ops, entries); failed != nil {
+			return
+		}
+
+		results = make([]*BatchResult, 0, len(ops))
+		for _, op := range ops {
+			entry := entries[op.Key]
+
+			switch op.Op {
+			case TxnPut:
+				if entry == nil {
+					//Nobody else can see it until the DataStore is unlocked.
+					entry = &Entry{Key: op.Key, used: time.Now()}
+					d.add(entry)
+					entries[op.Key] = entry
+				}
+
+				d.setValue(entry, op.Value)
+				if op.Release && entry.IsLocked() {
+					logger.Infof("Removing lock from entry: %s", op.Key)
+					entry.UnsetLockId()
+				}
+				results = append(results, &BatchResult{Key: op.Key, Status: http.StatusOK, Revision: entry.GetRevision()})
+
+			case TxnDelete:
+				if entry == nil {
+					results = append(results, &BatchResult{Key: op.Key, Status: http.StatusNotFound})
+					continue
+				}
+
+				d.unload(op.Key)
+				logDelete(op.Key)
+				locks.DeleteLock(entry.GetLockId())
+				delete(entries, op.Key)
+				deleted = append(deleted, op.Key)
+				results = append(results, &BatchResult{Key: op.Key, Status: http.StatusNoContent})
+			}
+		}
+	})
+
+	//Anyone waiting to reserve a deleted key is told.
+	for _, key := range deleted {
+		deleteEntry <- AcquireAction{Key: key}
+	}
+	return succeeded, results, failed
+}
+
+func runTxn(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /txn, request id: %s", random.String(5))
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("Error occured reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	txn := &Txn{}
+	if err := json.Unmarshal(body, txn); err != nil {
+		logger.Infof("Invalid request, bad transaction json: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	succeeded := false
+	var results []*BatchResult
+	err = txn.Validate()
+	if err == nil {
+		succeeded, results, err = data.Commit(txn)
+	}
+
+	status := http.StatusOK
+	reply := map[string]interface{}{"succeeded": succeeded, "results": results}
+	if failed, ok := err.(*TxnError); ok {
+		logger.Infof("Invalid request, %s", failed)
+		status = failed.Status
+		reply = map[string]interface{}{"key": failed.Key, "error": failed.Reason}
+	}
+
+	j, err := json.Marshal(reply)
+	if err != nil {
+		logger.Errorf("Error marshaling transaction results to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+	logger.Infof("Handled transaction of %d keys, succeeded: %t", len(txn.Keys()), succeeded)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+)
+
+// EntryState is the full persisted form of an Entry, including the
+// fields the public JSON representation leaves out.
+type EntryState struct {
+	Key      string            `json:"key"`
+	Type     EntryType         `json:"type,omitempty"`
+	Value    string            `json:"value,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Members  []string          `json:"members,omitempty"`
+	Scores   []ScoredMember    `json:"scores,omitempty"`
+	Messages []*QueueMessage   `json:"messages,omitempty"`
+	LockId   string            `json:"lock_id,omitempty"`
+	Revision int64             `json:"revision,omitempty"`
+	History  []Revision        `json:"history,omitempty"`
+
+	ContentType string     `json:"content_type,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+}
+
+func (e *Entry) State() *EntryState {
+	// e.Lock()
+	// defer e.Unlock()
+	s := &EntryState{
+		Key:      e.Key,
+		Type:     e.Type,
+		Value:    e.Value,
+		LockId:   e.LockId,
+		Revision: e.Revision,
+		History:  append([]Revision{}, e.History...),
+		Members:  append([]string{}, e.Members...),
+		Scores:   append([]ScoredMember{}, e.Scores...),
+
+		ContentType: e.ContentType,
+	}
+	if !e.Expires.IsZero() {
+		expires := e.Expires
+		s.Expires = &expires
+	}
+	if e.Fields != nil {
+		s.Fields = e.GetFields()
+	}
+	for _, m := range e.Messages {
+		c := *m
+		s.Messages = append(s.Messages, &c)
+	}
+	return s
+}
+
+// apply overwrites the entry with the state in place, so anyone already
+// holding the entry, such as a waiting locker, carries on with it.
+func (e *Entry) apply(s *EntryState) {
+	e.Type = s.Type
+	e.Value = s.Value
+	e.Fields = s.Fields
+	e.Members = s.Members
+	e.Scores = s.Scores
+	e.Messages = s.Messages
+	e.LockId = s.LockId
+	e.Revision = s.Revision
+	e.History = s.History
+	e.ContentType = s.ContentType
+	e.Expires = s.expiry()
+}
+
+// expiry is when the entry expires, or a zero time for never.
+func (s *EntryState) expiry() time.Time {
+	if s.Expires == nil {
+		return time.Time{}
+	}
+	return *s.Expires
+}
+
+func (s *EntryState) Entry() *Entry {
+	e := &Entry{Key: s.Key}
+	e.apply(s)
+	return e
+}
+
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+	EventLock   = "lock"
+	EventUnlock = "unlock"
+)
+
+// WALRecord is one change. Op is how to apply it, Event is what happened
+// from a client's point of view, and Rev is the revision it was made at.
+type WALRecord struct {
+	Rev   int64       `json:"rev,omitempty"`
+	Op    string      `json:"op"`
+	Event string      `json:"event,omitempty"`
+	Key   string      `json:"key"`
+	Entry *EntryState `json:"entry,omitempty"`
+}
+
+// WriteAheadLog is an append-only file of JSON records, one per line.
+// Every record is the whole state of one entry after a mutation, so
+// replaying is just a matter of keeping the last record for each key.
+type WriteAheadLog struct {
+	sync.Mutex
+	file   *os.File
+	path   string
+	policy string
+}
+
+func OpenWAL(path, policy string) (*WriteAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open write-ahead log: %s", err)
+	}
+	return &WriteAheadLog{file: file, path: path, policy: policy}, nil
+}
+
+// compactingPath is where the log is moved aside while a snapshot of
+// everything in it is being written.
+func compactingPath(path string) string {
+	return path + ".compacting"
+}
+
+func (l *WriteAheadLog) Append(rec *WALRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal write-ahead log record: %s", err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Unable to write write-ahead log record: %s", err)
+	}
+
+	if l.policy == FsyncAlways {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+func (l *WriteAheadLog) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Sync()
+}
+
+// Rotate moves the current log aside to the compacting path and starts
+// a fresh one, so new records land after whatever a snapshot captures.
+// If an earlier snapshot failed, the current log is added onto the end
+// of the one still waiting to be compacted.
+func (l *WriteAheadLog) Rotate() (string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.file.Sync()
+	l.file.Close()
+
+	old := compactingPath(l.path)
+	if _, err := os.Stat(old); err == nil {
+		if err := appendFile(old, l.path); err != nil {
+			return "", fmt.Errorf("Unable to rotate write-ahead log: %s", err)
+		}
+		os.Remove(l.path)
+	} else if err := os.Rename(l.path, old); err != nil {
+		return "", fmt.Errorf("Unable to rotate write-ahead log: %s", err)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return "", fmt.Errorf("Unable to open write-ahead log: %s", err)
+	}
+	l.file = file
+
+	return old, nil
+}
+
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func (l *WriteAheadLog) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	l.file.Sync()
+	return l.file.Close()
+}
+
+// ReplayWAL applies every record in the log at path to the DataStore.
+func ReplayWAL(path string, d *DataStore) (int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Unable to open write-ahead log: %s", err)
+	}
+	defer file.Close()
+
+	d.Lock()
+	defer d.Unlock()
+
+	return readRecords(file, func(rec *WALRecord, offset int64, length int) error {
+		switch rec.Op {
+		case "put":
+			d.load(rec.Entry)
+		case "delete":
+			d.unload(rec.Key)
+		default:
+			return fmt.Errorf("Unknown write-ahead log operation at offset %d: %s", offset, rec.Op)
+		}
+		changes.Replay(rec)
+		return nil
+	})
+}
+
+// readRecords hands each record in file to fn along with where it sits.
+// A torn record at the very end, left by a crash mid-write, is cut off
+// so later appends start on a clean line. Damage anywhere else is an error.
+func readRecords(file *os.File, fn func(rec *WALRecord, offset int64, length int) error) (int, error) {
+	reader := bufio.NewReader(file)
+	var offset int64
+	count := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return count, nil
+		}
+
+		var rec WALRecord
+		if err == nil {
+			err = json.Unmarshal(line, &rec)
+		}
+
+		if err != nil {
+			//Only the final record may be torn.
+			if _, peek := reader.Peek(1); peek != io.EOF {
+				return count, fmt.Errorf("Corrupt record at offset %d of %s: %s", offset, file.Name(), err)
+			}
+			logger.Warnf("Truncating torn record at offset %d of %s.", offset, file.Name())
+			return count, file.Truncate(offset)
+		}
+
+		if err := fn(&rec, offset, len(line)); err != nil {
+			return count, err
+		}
+
+		offset += int64(len(line))
+		count++
+	}
+}
+
+// logPut records the current state of the entry. Lock ownership is only
+// persisted when Config.App.WALLocks is set, otherwise locks start fresh.
+func (e *Entry) logPut() {
+	logState(e.State())
+}
+
+// logState records a state that was applied directly to the DataStore.
+func logState(s *EntryState) {
+	record(&WALRecord{Op: "put", Event: EventPut, Key: s.Key, Entry: s})
+}
+
+// logLock records a lock grant or release. It always makes the change
+// feed, but is only persisted along with the entry if locks are.
+func (e *Entry) logLock() {
+	event := EventUnlock
+	if e.LockId != "" {
+		event = EventLock
+	}
+	record(&WALRecord{Op: "put", Event: event, Key: e.Key, Entry: e.State()})
+}
+
+// persistLocks is whether lock ownership is recorded along with entries.
+// A cluster always replicates it, so locks survive losing the leader.
+func persistLocks() bool {
+	return Config.App.WALLocks || cluster != nil
+}
+
+// isLockEvent is whether rec only changed who holds the lock.
+func isLockEvent(rec *WALRecord) bool {
+	return rec.Event == EventLock || rec.Event == EventUnlock
+}
+
+func logDelete(key string) {
+	record(&WALRecord{Op: "delete", Event: EventDelete, Key: key})
+}
+
+// record proposes a change to the cluster, if there is one, and then
+// logs it locally.
+func record(rec *WALRecord) {
+	if cluster != nil {
+		if _, err := cluster.Propose(rec); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	logLocal(rec)
+}
+
+// logLocal gives a change the next revision and hands it to the change
+// log and watchers, and then to the write-ahead log if there is one.
+func logLocal(rec *WALRecord) {
+	c := *rec
+	c.Rev = changes.Append(rec)
+	watchers.Notify(&c)
+
+	if wal == nil {
+		return
+	}
+
+	if !persistLocks() {
+		if isLockEvent(&c) {
+			return
+		}
+		c.Entry = withoutLock(c.Entry)
+	}
+
+	if err := wal.Append(&c); err != nil {
+		logger.Error(err)
+	}
+}
+
+// withoutLock returns s with the lock ownership left out.
+func withoutLock(s *EntryState) *EntryState {
+	if s == nil || s.LockId == "" {
+		return s
+	}
+	c := *s
+	c.LockId = ""
+	return &c
+}
+
+func loadWAL() {
+	if Config.App.WALPath == "" {
+		logger.Info("No write-ahead log configured, data will not be persisted.")
+		return
+	}
+
+	//A log left over from an interrupted compaction comes first. Its
+	//records are never newer than the snapshot, so replaying it is safe.
+	for _, path := range []string{compactingPath(Config.App.WALPath), Config.App.WALPath} {
+		count, err := ReplayWAL(path, &data)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("Replayed %d write-ahead log records from: %s", count, path)
+	}
+
+	var err error
+
+	wal, err = OpenWAL(Config.App.WALPath, Config.App.WALFsync)
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
+
+func startWALSyncer(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	logger.Info("Started WAL Syncer Gouroutine.")
+	for {
+		select {
+
+		case <-ticker.C:
+			if err := wal.Sync(); err != nil {
+				logger.Errorf("Error syncing write-ahead log: %s", err)
+			}
+
+		case <-stop:
+			logger.Info("Stopped WAL Syncer Goroutine.")
+			return
+
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "httpdb.wal")
+
+	wal, err = OpenWAL(path, FsyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	changes = NewChangeLog(100)
+	defer func() { changes = nil }()
+
+	entry, _ := data.NewEntry("kept")
+	entry.SetValue("one")
+	entry.SetValue("two")
+	entry.SetLockId("lock")
+
+	data.NewEntry("deleted")
+	data.DeleteEntry("deleted")
+
+	hash := &Entry{Key: "hash", Type: HashEntry}
+	data.AddEntry(hash)
+	hash.SetField("name", "value")
+
+	wal.Close()
+	wal = nil
+
+	rev := changes.Seq()
+	changes = NewChangeLog(100)
+
+	restored := DataStore{Entries: make(map[string]*Entry)}
+	count, err := ReplayWAL(path, &restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 7 {
+		t.Errorf("Should have replayed 7 records. Replayed: %d", count)
+	}
+
+	//The lock grant isn't persisted, but its revision is never reused.
+	if changes.Seq() != rev {
+		t.Errorf("Revisions should carry on from where they were. Expected: %d, received: %d", rev, changes.Seq())
+	}
+
+	if pending, _, ok := changes.Since(3); !ok || len(pending) != 4 || pending[0].Rev != 5 || pending[3].Rev != rev {
+		t.Errorf("Replayed changes should be in the change log. Received: %v", pending)
+	}
+
+	if restored.EntryExists("deleted") {
+		t.Error("Deleted entry should not be restored.")
+	}
+
+	kept, err := restored.GetEntry("kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kept.GetValue() != "two" || kept.GetRevision() != 2 || len(kept.GetHistory()) != 2 {
+		t.Error("Restored entry should have its latest value and history.")
+	}
+
+	if kept.IsLocked() {
+		t.Error("Locks should not be persisted unless configured.")
+	}
+
+	h, err := restored.GetEntry("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := h.GetField("name"); v != "value" || !h.IsType(HashEntry) {
+		t.Error("Restored hash should keep its type and fields.")
+	}
+}
+
+func TestWALReplayTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "httpdb.wal")
+
+	good := `{"op":"put","key":"a","entry":{"key":"a","value":"x"}}` + "\n"
+	err = ioutil.WriteFile(path, []byte(good+`{"op":"put","key":"b","en`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := DataStore{Entries: make(map[string]*Entry)}
+	count, err := ReplayWAL(path, &restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 || !restored.EntryExists("a") || restored.EntryExists("b") {
+		t.Error("Only the complete record should be replayed.")
+	}
+
+	contents, _ := ioutil.ReadFile(path)
+	if string(contents) != good {
+		t.Error("Torn record should be truncated from the log.")
+	}
+
+	err = ioutil.WriteFile(path, []byte("garbage\n"+good), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ReplayWAL(path, &DataStore{Entries: make(map[string]*Entry)})
+	if err == nil {
+		t.Error("Corruption before the tail should be an error.")
+	}
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Config.App.WALPath = filepath.Join(dir, "httpdb.wal")
+	Config.App.SnapshotDir = dir
+	defer func() {
+		Config.App.WALPath = ""
+		Config.App.SnapshotDir = ""
+	}()
+
+	wal, err = OpenWAL(Config.App.WALPath, FsyncNever)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+
+	before, _ := data.NewEntry("before")
+	before.SetValue("old")
+
+	if err := takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	before.SetValue("new")
+	data.NewEntry("after")
+
+	wal.Close()
+	wal = nil
+
+	if _, err := os.Stat(compactingPath(Config.App.WALPath)); !os.IsNotExist(err) {
+		t.Error("Compacted log should be removed after the snapshot.")
+	}
+
+	count, err := ReplayWAL(Config.App.WALPath, &DataStore{Entries: make(map[string]*Entry)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Errorf("Log should only hold the records since the snapshot. Holds: %d", count)
+	}
+
+	data = DataStore{Entries: make(map[string]*Entry)}
+	loadSnapshot()
+
+	if e, err := data.GetEntry("before"); err != nil || e.GetValue() != "old" {
+		t.Error("Snapshot should hold the state when it was taken.")
+	}
+
+	loadWAL()
+	wal.Close()
+	wal = nil
+
+	if e, err := data.GetEntry("before"); err != nil || e.GetValue() != "new" {
+		t.Error("Log tail should be replayed over the snapshot.")
+	}
+
+	if !data.EntryExists("after") {
+		t.Error("Entries created after the snapshot should be restored.")
+	}
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	older, err := WriteSnapshot(dir, &Snapshot{Time: time.Unix(1, 0), Entries: []*EntryState{{Key: "a", Value: "older"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newer, err := WriteSnapshot(dir, &Snapshot{Time: time.Unix(2, 0), Entries: []*EntryState{{Key: "a", Value: "newer"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Tear the newest snapshot.
+	contents, _ := ioutil.ReadFile(newer)
+	ioutil.WriteFile(newer, contents[:len(contents)-5], 0644)
+
+	d := DataStore{Entries: make(map[string]*Entry)}
+	if _, err := LoadLatestSnapshot(dir, &d); err == nil || d.EntryExists("a") {
+		t.Fatal("Should refuse to load anything while the newest snapshot is torn.")
+	}
+
+	//Once it's moved aside, the older one is loaded.
+	os.Rename(newer, newer+".broken")
+	path, err := LoadLatestSnapshot(dir, &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != older {
+		t.Errorf("Should load the older snapshot. Loaded: %s", path)
+	}
+
+	if e, _ := d.GetEntry("a"); e == nil || e.GetValue() != "older" {
+		t.Error("Older snapshot contents should be loaded.")
+	}
+}
+
+func TestSnapshotVersion1(t *testing.T) {
+	body := `{"time":"2020-01-01T00:00:00Z","entries":[{"key":"a","value":"old"}]}`
+	file := fmt.Sprintf("HTTPDBSNAP 1 %d %08x\n%s", len(body), crc32.ChecksumIEEE([]byte(body)), body)
+
+	snap, err := DecodeSnapshot(strings.NewReader(file), "version 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Entries) != 1 || snap.Entries[0].Value != "old" {
+		t.Error("Version 1 snapshots should still be read.")
+	}
+
+	if _, err := DecodeSnapshot(strings.NewReader(file[:len(file)-1]), "version 1"); err == nil {
+		t.Error("Torn version 1 snapshots should be refused.")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/random"
+)
+
+// Watchers wakes up requests waiting on changes to a key. It is handed
+// every change as it is logged, so it sees the same ones as the change log.
+type Watchers struct {
+	sync.Mutex
+	keys map[string]*keyWatch
+}
+
+type keyWatch struct {
+	wake    chan struct{}
+	waiting int
+}
+
+var watchers = &Watchers{keys: make(map[string]*keyWatch)}
+
+// Wait returns a channel that is closed by the next change to key, and a
+// function to call once the caller is no longer waiting on it.
+func (w *Watchers) Wait(key string) (<-chan struct{}, func()) {
+	w.Lock()
+	defer w.Unlock()
+
+	kw, exists := w.keys[key]
+	if !exists {
+		kw = &keyWatch{wake: make(chan struct{})}
+		w.keys[key] = kw
+	}
+	kw.waiting++
+
+	return kw.wake, func() {
+		w.Lock()
+		defer w.Unlock()
+
+		kw.waiting--
+		if kw.waiting == 0 && w.keys[key] == kw {
+			delete(w.keys, key)
+		}
+	}
+}
+
+// Notify wakes everyone waiting on the key rec changed.
+func (w *Watchers) Notify(rec *WALRecord) {
+	w.Lock()
+	defer w.Unlock()
+
+	if kw, exists := w.keys[rec.Key]; exists {
+		close(kw.wake)
+		delete(w.keys, rec.Key)
+	}
+}
+
+// WaitForRevision blocks until the entry for key is past the revision
+// after, or the timeout elapses. A negative after waits for the next
+// revision. The entry going away, or the request being given up on,
+// is an error.
+func (d *DataStore) WaitForRevision(ctx context.Context, key string, after int64, timeout time.Duration) (bool, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		wake, done := watchers.Wait(key)
+
+		entry, err := d.GetEntry(key)
+		if err != nil {
+			done()
+			return false, err
+		}
+
+		entry.Lock()
+		revision := entry.GetRevision()
+		entry.Unlock()
+
+		if after < 0 {
+			after = revision
+		}
+		if revision > after {
+			done()
+			return true, nil
+		}
+
+		select {
+		case <-wake:
+			done()
+		case <-deadline.C:
+			done()
+			return false, nil
+		case <-ctx.Done():
+			done()
+			return false, ctx.Err()
+		}
+	}
+}
+
+// watchEvents streams every change to keys under a prefix as server-sent
+// events, with the change's revision as the event id so a client that
+// reconnects with Last-Event-ID picks up where it left off.
+func watchEvents(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /watch, request id: %s", random.String(5))
+
+	prefix := r.URL.Query().Get("prefix")
+
+	if changes == nil {
+		logger.Info("Invalid request, no change log is kept.")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	seq := changes.Seq()
+	if last := r.Header.Get("Last-Event-ID"); last != "" {
+		var err error
+		if seq, err = strconv.ParseInt(last, 10, 64); err != nil || seq < 0 {
+			logger.Infof("Invalid request, bad Last-Event-ID: %s", last)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	flusher, canFlush := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	logger.Infof("Streaming changes to keys with prefix: %s", prefix)
+
+	for {
+		pending, wake, ok := changes.Since(seq)
+
+		//Changes were missed, so the client has to fetch everything again.
+		if !ok {
+			seq = changes.Seq()
+			logger.Infof("Watcher for prefix %s missed changes, sending a reset at revision %d.", prefix, seq)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {\"rev\":%d}\n\n", seq, seq); err != nil {
+				return
+			}
+			pending, wake, _ = changes.Since(seq)
+		}
+
+		for _, change := range pending {
+			seq = change.Rev
+			if !strings.HasPrefix(change.Key, prefix) {
+				continue
+			}
+
+			c := *change
+			c.Entry = withoutLock(c.Entry)
+			j, err := json.Marshal(&c)
+			if err != nil {
+				logger.Errorf("Error marshaling change to json: %s", err)
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Rev, c.Event, j); err != nil {
+				return
+			}
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			if _, err := w.Write([]byte(":\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		}
+	}
+}
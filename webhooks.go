@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/mux"
+)
+
+const (
+	signatureHeader    = "X-Httpdb-Signature"
+	webhookEventHeader = "X-Httpdb-Event"
+)
+
+// webhookAttempts is how many times a delivery is tried before it is
+// given up on, and webhookQueueSize how many changes can wait for one.
+const (
+	webhookAttempts  = 5
+	webhookQueueSize = 1000
+)
+
+// webhookBackoff is the wait before the first retry. It doubles for each
+// one after that.
+var webhookBackoff = time.Second
+
+var webhookEvents = []string{EventPut, EventDelete, EventLock, EventUnlock}
+
+var webhooks = &WebhookStore{hooks: make(map[string]*Webhook), changed: make(chan struct{}, 1)}
+
+// Webhook is a subscription to changes to keys starting with Prefix. If
+// Events is empty every kind of change is sent.
+type Webhook struct {
+	Id     string   `json:"id"`
+	Url    string   `json:"url"`
+	Prefix string   `json:"prefix"`
+	Events []string `json:"events,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// Validate checks the subscription can be delivered to.
+func (h *Webhook) Validate() error {
+	u, err := url.Parse(h.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Webhook url must be an absolute http or https url: %s", h.Url)
+	}
+
+	for _, event := range h.Events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return fmt.Errorf("Unknown webhook event type: %s", event)
+		}
+	}
+
+	if strings.ContainsAny(h.Id, "/ ") {
+		return fmt.Errorf("Webhook id can't contain slashes or spaces: %s", h.Id)
+	}
+	return nil
+}
+
+func (h *Webhook) Matches(rec *WALRecord) bool {
+	if !strings.HasPrefix(rec.Key, h.Prefix) {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, event := range h.Events {
+		if event == rec.Event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the body POSTed to a subscriber for each change.
+type WebhookPayload struct {
+	Webhook string      `json:"webhook"`
+	Rev     int64       `json:"rev"`
+	Event   string      `json:"event"`
+	Key     string      `json:"key"`
+	Entry   *EntryState `json:"entry,omitempty"`
+}
+
+// signWebhook is the HMAC-SHA256 of body under the subscription's secret,
+// sent in the X-Httpdb-Signature header so subscribers can tell a payload
+// came from httpdb.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookQueue delivers one subscription's changes, one at a time and in
+// order, so a subscriber that is down holds up only its own deliveries.
+type webhookQueue struct {
+	hook    *Webhook
+	pending chan *WALRecord
+	stop    chan struct{}
+}
+
+func newWebhookQueue(hook *Webhook) *webhookQueue {
+	q := &webhookQueue{
+		hook:    hook,
+		pending: make(chan *WALRecord, webhookQueueSize),
+		stop:    make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *webhookQueue) Send(rec *WALRecord) {
+	select {
+	case q.pending <- rec:
+	default:
+		logger.Warnf("Webhook %s is too far behind, dropping change at revision %d.", q.hook.Id, rec.Rev)
+	}
+}
+
+func (q *webhookQueue) run() {
+	for {
+		select {
+		case rec := <-q.pending:
+			if err := q.deliver(rec); err != nil {
+				logger.Warn(err)
+			}
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// deliver posts the change, retrying with backoff until the subscriber
+// takes it or webhookAttempts is used up.
+func (q *webhookQueue) deliver(rec *WALRecord) error {
+	body, err := json.Marshal(&WebhookPayload{
+		Webhook: q.hook.Id,
+		Rev:     rec.Rev,
+		Event:   rec.Event,
+		Key:     rec.Key,
+		Entry:   withoutLock(rec.Entry),
+	})
+	if err != nil {
+		return fmt.Errorf("Error marshaling webhook payload to json: %s", err)
+	}
+
+	wait := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = q.post(rec, body)
+		if err == nil {
+			logger.Debugf("Delivered revision %d to webhook %s.", rec.Rev, q.hook.Id)
+			return nil
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+
+		logger.Infof("Retrying webhook %s in %s: %s", q.hook.Id, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-q.stop:
+			return nil
+		}
+		wait *= 2
+	}
+
+	return fmt.Errorf("Giving up on delivering revision %d to webhook %s: %s", rec.Rev, q.hook.Id, err)
+}
+
+func (q *webhookQueue) post(rec *WALRecord, body []byte) error {
+	req, err := http.NewRequest("POST", q.hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, rec.Event)
+	req.Header.Set(signatureHeader, signWebhook(q.hook.Secret, body))
+
+	client := &http.Client{Timeout: time.Second * Config.App.TimeOut}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Subscriber responded: %s", resp.Status)
+	}
+	return nil
+}
+
+// WebhookStore holds the subscriptions, apart from the entries so they
+// never turn up in listings, backups, the change feed or replication,
+// and can only be changed through /admin/webhooks. They are saved to a
+// file of their own, unless its path is empty.
+type WebhookStore struct {
+	sync.Mutex
+	path    string
+	hooks   map[string]*Webhook
+	changed chan struct{}
+}
+
+// Add saves a new subscription, and returns false if its id is taken.
+func (s *WebhookStore) Add(hook *Webhook) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, exists := s.hooks[hook.Id]; exists {
+		return false, nil
+	}
+	h := *hook
+	s.hooks[h.Id] = &h
+
+	if err := s.save(); err != nil {
+		delete(s.hooks, h.Id)
+		return true, err
+	}
+	s.notify()
+	return true, nil
+}
+
+// Remove deletes a subscription, and returns whether there was one.
+func (s *WebhookStore) Remove(id string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	h, exists := s.hooks[id]
+	if !exists {
+		return false, nil
+	}
+	delete(s.hooks, id)
+
+	if err := s.save(); err != nil {
+		s.hooks[id] = h
+		return true, err
+	}
+	s.notify()
+	return true, nil
+}
+
+// All returns a copy of every subscription, secrets included.
+func (s *WebhookStore) All() map[string]*Webhook {
+	s.Lock()
+	defer s.Unlock()
+
+	hooks := make(map[string]*Webhook, len(s.hooks))
+	for id, h := range s.hooks {
+		copied := *h
+		hooks[id] = &copied
+	}
+	return hooks
+}
+
+// Changed is sent on after subscriptions are added or removed.
+func (s *WebhookStore) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func (s *WebhookStore) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// save writes every subscription out to the file. Only the owner can
+// read it, as it holds the secrets. Expects the lock to be held.
+func (s *WebhookStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	hooks := make([]*Webhook, 0, len(s.hooks))
+	for _, h := range s.hooks {
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Id < hooks[j].Id })
+
+	body, err := json.Marshal(hooks)
+	if err != nil {
+		return fmt.Errorf("Unable to marshal webhooks: %s", err)
+	}
+
+	//A file left over from before may not be private.
+	tmp := s.path + ".tmp"
+	os.Remove(tmp)
+	if err := writeSynced(tmp, body, 0600); err != nil {
+		return fmt.Errorf("Unable to write webhooks: %s", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("Unable to rename webhooks file: %s", err)
+	}
+	return nil
+}
+
+// load reads the subscriptions back from the file, if there is one yet.
+func (s *WebhookStore) load() error {
+	s.Lock()
+	defer s.Unlock()
+
+	body, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read webhooks: %s", err)
+	}
+
+	hooks := []*Webhook{}
+	if err := json.Unmarshal(body, &hooks); err != nil {
+		return fmt.Errorf("Unable to parse webhooks file %s: %s", s.path, err)
+	}
+	for _, h := range hooks {
+		s.hooks[h.Id] = h
+	}
+	return nil
+}
+
+// nodeLocal is whether r is for the subscriptions, which each node keeps
+// and delivers for itself, so it is served by whichever node it is sent
+// to.
+func nodeLocal(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/admin/webhooks")
+}
+
+func loadWebhooks() {
+	webhooks.path = Config.App.WebhooksPath
+	if err := webhooks.load(); err != nil {
+		logger.Fatal(err)
+	}
+	logger.Infof("Loaded %d webhooks: %s", len(webhooks.hooks), webhooks.path)
+}
+
+// syncWebhookQueues starts a queue for each new or changed subscription,
+// and stops those for subscriptions that are gone.
+func syncWebhookQueues(queues map[string]*webhookQueue) {
+	hooks := webhooks.All()
+
+	for id, q := range queues {
+		if h, exists := hooks[id]; !exists || fmt.Sprint(*h) != fmt.Sprint(*q.hook) {
+			close(q.stop)
+			delete(queues, id)
+		}
+	}
+
+	for id, h := range hooks {
+		if _, exists := queues[id]; !exists {
+			queues[id] = newWebhookQueue(h)
+		}
+	}
+}
+
+func startWebhooks(stop chan struct{}) {
+	logger.Info("Started Webhook Gouroutine.")
+
+	queues := make(map[string]*webhookQueue)
+	syncWebhookQueues(queues)
+
+	seq := changes.Seq()
+	for {
+		//Pick up subscriptions added since, before sending anything more.
+		select {
+		case <-webhooks.Changed():
+			syncWebhookQueues(queues)
+		default:
+		}
+
+		pending, wake, ok := changes.Since(seq)
+		if !ok {
+			logger.Warnf("Webhooks fell behind the change log, changes up to revision %d were not sent.", changes.Seq())
+			seq = changes.Seq()
+			continue
+		}
+
+		//Every node sees every change, whether it made it or was sent it by
+		//its leader, so subscriptions are kept to whichever node holds them
+		//whatever its role, and carry on through failover and promotion.
+		for _, change := range pending {
+			seq = change.Rev
+			for _, q := range queues {
+				if q.hook.Matches(change) {
+					q.Send(change)
+				}
+			}
+		}
+
+		select {
+		case <-wake:
+		case <-webhooks.Changed():
+			syncWebhookQueues(queues)
+		case <-stop:
+			for _, q := range queues {
+				close(q.stop)
+			}
+			logger.Info("Stopped Webhook Goroutine.")
+			return
+		}
+	}
+}
+
+func addWebhook(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received POST request to /admin/webhooks, request id: %s", random.String(5))
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("Error occured reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	hook := &Webhook{}
+	if err := json.Unmarshal(body, hook); err != nil {
+		logger.Infof("Invalid request, bad webhook json: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if hook.Id == "" {
+		hook.Id = random.String(8)
+	}
+	if hook.Secret == "" {
+		hook.Secret = random.String(32)
+	}
+
+	if err := hook.Validate(); err != nil {
+		logger.Infof("Invalid request, %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	added, err := webhooks.Add(hook)
+	if err != nil {
+		logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		logger.Infof("Invalid request, webhook already exists: %s", hook.Id)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	j, err := json.Marshal(hook)
+	if err != nil {
+		logger.Errorf("Error marshaling webhook to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(j)
+	logger.Infof("Handled successful request for webhook: %s", hook.Id)
+}
+
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("Received GET request to /admin/webhooks, request id: %s", random.String(5))
+
+	//Secrets are only handed out when the webhook is added.
+	hooks := []*Webhook{}
+	for _, h := range webhooks.All() {
+		h.Secret = ""
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Id < hooks[j].Id })
+
+	j, err := json.Marshal(hooks)
+	if err != nil {
+		logger.Errorf("Error marshaling webhooks to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for %d webhooks.", len(hooks))
+}
+
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received DELETE request to /admin/webhooks/{id}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	id := vars["id"]
+	removed, err := webhooks.Remove(id)
+	if err != nil {
+		logger.Error(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		logger.Infof("Invalid request, webhook not found: %s", id)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for webhook: %s", id)
+}
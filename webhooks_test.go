@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	data = DataStore{Entries: make(map[string]*Entry)}
+	locks = LockStore{Locks: make(map[string]struct{})}
+	changes = NewChangeLog(100)
+	defer func() { changes = nil }()
+
+	dir, err := ioutil.TempDir("", "httpdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "httpdb.webhooks")
+	webhooks = &WebhookStore{path: path, hooks: make(map[string]*Webhook), changed: make(chan struct{}, 1)}
+	defer func() { webhooks = &WebhookStore{hooks: make(map[string]*Webhook), changed: make(chan struct{}, 1)} }()
+
+	backoff := webhookBackoff
+	webhookBackoff = time.Millisecond * 10
+	defer func() { webhookBackoff = backoff }()
+
+	var mu sync.Mutex
+	var secret string
+	attempts := 0
+	received := []string{}
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		//Fail the first delivery so it has to be retried.
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if r.Header.Get(signatureHeader) != signWebhook(secret, body) {
+			t.Error("Payloads should be signed with the webhook's secret.")
+		}
+
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+		received = append(received, fmt.Sprintf("%s %s %s", payload.Webhook, payload.Event, payload.Key))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer subscriber.Close()
+
+	req, err := http.NewRequest("POST", "/admin/webhooks", strings.NewReader(`{"url":"not a url"}`))
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusBadRequest, w.Code)
+
+	body := fmt.Sprintf(`{"id":"conf","url":"%s","prefix":"conf/","events":["put","delete"]}`, subscriber.URL)
+	req, err = http.NewRequest("POST", "/admin/webhooks", strings.NewReader(body))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusCreated, w.Code)
+
+	var hook Webhook
+	if err := json.Unmarshal(w.Body.Bytes(), &hook); err != nil {
+		t.Errorf("Unmarshal error: %s", err)
+	}
+	if hook.Secret == "" {
+		t.Fatal("A secret should be made up for the webhook.")
+	}
+	mu.Lock()
+	secret = hook.Secret
+	mu.Unlock()
+
+	//Subscriptions are kept apart from the entries, and saved privately.
+	if len(data.Entries) != 0 {
+		t.Error("Webhooks should not be stored as entries.")
+	}
+	req, err = http.NewRequest("PUT", "/hashes/_webhook:x/url", strings.NewReader("http://127.0.0.1:1"))
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	if len(webhooks.All()) != 1 {
+		t.Error("Writing a hash should not add a webhook.")
+	}
+	data.DeleteEntry("_webhook:x")
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Webhooks should be saved to a file only the owner can read: %v", err)
+	}
+	reloaded := &WebhookStore{path: path, hooks: make(map[string]*Webhook)}
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if h := reloaded.All()["conf"]; h == nil || h.Secret != hook.Secret || h.Url != subscriber.URL {
+		t.Error("Webhooks should be loaded back from their file.")
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		startWebhooks(stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	entry, _ := data.NewEntry("conf/a")
+	entry.Lock()
+	entry.SetLockId("lock")
+	entry.SetValue("one")
+	entry.UnsetLockId()
+	entry.Unlock()
+	data.NewEntry("other")
+	data.DeleteEntry("conf/a")
+
+	expected := "conf put conf/a,conf put conf/a,conf delete conf/a"
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		mu.Lock()
+		got := strings.Join(received, ",")
+		mu.Unlock()
+
+		if got == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Matching changes should be delivered in order. Received: %s", got)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	//A follower sends the changes it has from its leader.
+	replica.Lock()
+	replica.leader = "http://leader"
+	replica.Unlock()
+	defer func() {
+		replica.Lock()
+		replica.leader = ""
+		replica.Unlock()
+	}()
+	data.Apply(&WALRecord{Op: "put", Event: EventPut, Key: "conf/b", Entry: &EntryState{Key: "conf/b", Value: "two"}})
+
+	expected += ",conf put conf/b"
+	for {
+		mu.Lock()
+		got := strings.Join(received, ",")
+		mu.Unlock()
+
+		if got == expected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Followers should deliver changes too. Received: %s", got)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	req, err = http.NewRequest("GET", "/admin/webhooks", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusOK, w.Code)
+
+	if strings.Contains(w.Body.String(), hook.Secret) || !strings.Contains(w.Body.String(), subscriber.URL) {
+		t.Errorf("Webhooks should be listed without their secrets. Received: %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("DELETE", "/admin/webhooks/conf", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNoContent, w.Code)
+
+	req, err = http.NewRequest("DELETE", "/admin/webhooks/conf", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w = httptest.NewRecorder()
+	muxr.ServeHTTP(w, req)
+	checkCode(t, http.StatusNotFound, w.Code)
+}
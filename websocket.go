@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsMaxMessage is the largest message the other end is allowed to send.
+const wsMaxMessage = 16 << 20
+
+var sessionUpgrader = websocket.Upgrader{CheckOrigin: checkSessionOrigin}
+
+// checkSessionOrigin lets a WebSocket be opened by clients that aren't
+// browsers, which send no Origin, by pages from the same host, and by
+// the origins in "session_origins". Browsers leave WebSockets out of the
+// same-origin policy, so without it any page a user visits could open a
+// session with whatever access the user has.
+func checkSessionOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range Config.App.SessionOrigins {
+		if strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	logger.Infof("Invalid request, session from another origin: %s", origin)
+	return false
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/btnmasher/random"
+	"github.com/gorilla/mux"
+)
+
+type ScoredMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+//Scores are kept ordered by score, then by member for equal scores,
+//so the slice index is the member's rank.
+
+func (e *Entry) scoreIndex(member string) int {
+	for i, s := range e.Scores {
+		if s.Member == member {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e *Entry) GetScore(member string) (float64, int, bool) {
+	// e.Lock()
+	// defer e.Unlock()
+	i := e.scoreIndex(member)
+	if i < 0 {
+		return 0, -1, false
+	}
+	return e.Scores[i].Score, i, true
+}
+
+func (e *Entry) SetScore(member string, score float64) {
+	// e.Lock()
+	// defer e.Unlock()
+	if i := e.scoreIndex(member); i >= 0 {
+		e.Scores = append(e.Scores[:i], e.Scores[i+1:]...)
+	}
+
+	i := sort.Search(len(e.Scores), func(i int) bool {
+		s := e.Scores[i]
+		return s.Score > score || (s.Score == score && s.Member >= member)
+	})
+
+	e.Scores = append(e.Scores, ScoredMember{})
+	copy(e.Scores[i+1:], e.Scores[i:])
+	e.Scores[i] = ScoredMember{Member: member, Score: score}
+	e.commit()
+}
+
+func (e *Entry) RemoveScore(member string) bool {
+	// e.Lock()
+	// defer e.Unlock()
+	i := e.scoreIndex(member)
+	if i < 0 {
+		return false
+	}
+	e.Scores = append(e.Scores[:i], e.Scores[i+1:]...)
+	e.commit()
+	return true
+}
+
+// RangeByRank returns members between two inclusive ranks. Negative
+// ranks count back from the highest score, so 0 and -1 is everything.
+func (e *Entry) RangeByRank(start, stop int) []ScoredMember {
+	// e.Lock()
+	// defer e.Unlock()
+	n := len(e.Scores)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+
+	members := []ScoredMember{}
+	for i := start; i <= stop; i++ {
+		members = append(members, e.Scores[i])
+	}
+	return members
+}
+
+// RangeByScore returns up to limit members with min <= score <= max.
+// A limit of zero or less means no limit.
+func (e *Entry) RangeByScore(min, max float64, limit int) []ScoredMember {
+	// e.Lock()
+	// defer e.Unlock()
+	i := sort.Search(len(e.Scores), func(i int) bool {
+		return e.Scores[i].Score >= min
+	})
+
+	members := []ScoredMember{}
+	for ; i < len(e.Scores) && e.Scores[i].Score <= max; i++ {
+		if limit > 0 && len(members) == limit {
+			break
+		}
+		members = append(members, e.Scores[i])
+	}
+	return members
+}
+
+func getZSetRange(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /zsets/{key}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//A min or max query selects a score range, otherwise a rank range.
+	query := r.URL.Query()
+	_, byMin := query["min"]
+	_, byMax := query["max"]
+	byScore := byMin || byMax
+
+	min, max := math.Inf(-1), math.Inf(1)
+	start, stop, limit := 0, -1, 0
+	var err error
+
+	if byScore {
+		if byMin {
+			min, err = strconv.ParseFloat(query.Get("min"), 64)
+		}
+		if err == nil && byMax {
+			max, err = strconv.ParseFloat(query.Get("max"), 64)
+		}
+		if err == nil && query.Get("limit") != "" {
+			limit, err = strconv.Atoi(query.Get("limit"))
+		}
+	} else {
+		if query.Get("start") != "" {
+			start, err = strconv.Atoi(query.Get("start"))
+		}
+		if err == nil && query.Get("stop") != "" {
+			stop, err = strconv.Atoi(query.Get("stop"))
+		}
+	}
+
+	if err != nil {
+		logger.Infof("Invalid range query specified: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(ZSetEntry) {
+		logger.Infof("Invalid request, entry is not a sorted set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	var members []ScoredMember
+	if byScore {
+		members = entry.RangeByScore(min, max, limit)
+	} else {
+		members = entry.RangeByRank(start, stop)
+	}
+
+	j, err := json.Marshal(members)
+	if err != nil {
+		logger.Errorf("Error marshaling members to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func getZSetMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received GET request to /zsets/{key}/members/{member}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and member.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	member, exists := vars["member"]
+	if !exists {
+		logger.Info("Invalid request, no member specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(ZSetEntry) {
+		logger.Infof("Invalid request, entry is not a sorted set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	score, rank, exists := entry.GetScore(member)
+	if !exists {
+		logger.Infof("Invalid request, not a member of sorted set: %s - %s", key, member)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		ScoredMember
+		Rank int `json:"rank"`
+	}{ScoredMember{member, score}, rank})
+	if err != nil {
+		logger.Errorf("Error marshaling member to json: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func setZSetMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received PUT request to /zsets/{key}/members/{member}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and member.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	member, exists := vars["member"]
+	if !exists {
+		logger.Info("Invalid request, no member specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//The score is the request body.
+	bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Errorf("Error reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	score, err := strconv.ParseFloat(strings.TrimSpace(string(bytes)), 64)
+	//Infinite scores can't be written out as JSON.
+	if err != nil || math.IsNaN(score) || math.IsInf(score, 0) {
+		logger.Infof("Invalid score specified: %s", string(bytes))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry if it exists.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Generating new sorted set entry for key: %s", key)
+		logger.Debugf("Received during GetEntry: %s", err)
+
+		//Didn't exist, make a new one!
+		entry = &Entry{Key: key, Type: ZSetEntry}
+		err = data.AddEntry(entry)
+		if err != nil {
+			logger.Debug(err)
+			entry, _ = data.GetEntry(key)
+		}
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(ZSetEntry) {
+		logger.Infof("Invalid request, entry is not a sorted set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", key, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	entry.SetScore(member, score)
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", key)
+}
+
+func removeZSetMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	logger.Infof("Received DELETE request to /zsets/{key}/members/{member}, request id: %s", random.String(5))
+	logger.Debugf("Received varaibles: %v", vars)
+
+	//Check to see if we actually got a key and member.
+	key, exists := vars["key"]
+	if !exists {
+		logger.Info("Invalid request, no key specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	member, exists := vars["member"]
+	if !exists {
+		logger.Info("Invalid request, no member specified.")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	//Get the reference to the entry for the specified key.
+	entry, err := data.GetEntry(key)
+	if err != nil {
+		logger.Infof("Invalid request, entry key not found: %s", key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if !entry.IsType(ZSetEntry) {
+		logger.Infof("Invalid request, entry is not a sorted set: %s", key)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if !validLockQuery(entry, r) {
+		logger.Debugf("LockId does not match entry: %s - Expected: %s", key, entry.GetLockId())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !entry.RemoveScore(member) {
+		logger.Infof("Invalid request, not a member of sorted set: %s - %s", key, member)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	logger.Infof("Handled successful request for: %s", key)
+}